@@ -1,28 +1,40 @@
 package app
 
 import (
+	"flag"
 	"fmt"
+	"os"
 
 	"github.com/ipoluianov/gomisc/logger"
 	"github.com/ipoluianov/map_u00_io/httpserver"
 )
 
+var configPath = flag.String("config", "", "Path to config.json (default: next to the executable)")
+
 func Start() {
 	logger.Println("Start begin")
 	TuneFDs()
 
-	httpserver.Instance.Start()
+	err := httpserver.Instance.Start(*configPath)
+	if err != nil {
+		logger.Println("Start ERROR", err)
+		os.Exit(1)
+	}
 
 	logger.Println("Start end")
 }
 
 func Stop() {
+	logger.Println("Stop begin")
+	httpserver.Instance.Stop()
+	logger.Println("Stop end")
 }
 
 func RunDesktop() {
 	logger.Println("Running as console application")
 	Start()
 	fmt.Scanln()
+	Stop()
 	logger.Println("Console application exit")
 }
 
@@ -0,0 +1,30 @@
+package frame
+
+// Error is a frame validation failure. Code is stable and can be passed
+// to clients as is.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+var (
+	ErrTooShort       = &Error{Code: "frame_too_short", Message: "frame too short"}
+	ErrTooLarge       = &Error{Code: "frame_too_large", Message: "frame too large"}
+	ErrBadSignature   = &Error{Code: "invalid_signature", Message: "invalid signature"}
+	ErrBadArchive     = &Error{Code: "bad_archive", Message: "payload is not a valid archive"}
+	ErrMissingEntry   = &Error{Code: "missing_entry", Message: "missing entry"}
+	ErrDuplicateEntry = &Error{Code: "duplicate_entry", Message: "duplicate entry"}
+	ErrTooManyEntries = &Error{Code: "too_many_entries", Message: "too many entries"}
+	ErrEntryTooLarge  = &Error{Code: "entry_too_large", Message: "entry too large"}
+	ErrBadTime        = &Error{Code: "bad_time", Message: "wrong time entry"}
+	ErrNoPrivateKey   = &Error{Code: "no_private_key", Message: "private key is not set"}
+	ErrBadVersion     = &Error{Code: "bad_version", Message: "unsupported frame version"}
+	ErrBadBody        = &Error{Code: "bad_body", Message: "malformed frame body"}
+	ErrUnknownTag     = &Error{Code: "unknown_tag", Message: "unknown tag"}
+	ErrBadOp          = &Error{Code: "bad_op", Message: "unknown operation"}
+	ErrBadEntry       = &Error{Code: "bad_entry", Message: "malformed entry"}
+)
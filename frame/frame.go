@@ -0,0 +1,157 @@
+package frame
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"time"
+)
+
+// A signed frame is [address 32][signature 64][payload]; the signature
+// covers the payload. Two payload formats are accepted:
+//
+//	v1 - a zip archive with at least the "value", "name" and "time" entries
+//	v2 - a version byte, a fixed binary header and a TLV body (see v2.go)
+const (
+	AddressSize   = ed25519.PublicKeySize
+	SignatureSize = ed25519.SignatureSize
+	HeaderSize    = AddressSize + SignatureSize
+
+	MaxDataSize   = 10 * 1024
+	MaxEntries    = 16
+	MaxNameSize   = 256
+	MaxPayloadLen = MaxDataSize + 4*1024
+
+	TimeFormat = "2006-01-02 15:04:05.000"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// ContentTypeEncrypted marks a value sealed for its recipients; servers
+// store it as opaque binary.
+const (
+	ContentTypeBinary    = 0
+	ContentTypeText      = 1
+	ContentTypeJSON      = 2
+	ContentTypeEncrypted = 3
+)
+
+const (
+	FlagDeflate = 0x01
+	FlagDelete  = 0x02
+)
+
+type Frame struct {
+	Address   []byte
+	Signature []byte
+	Payload   []byte
+
+	Version     int
+	Name        string
+	Value       []byte
+	Time        time.Time
+	Seq         uint64
+	ContentType byte
+	Flags       byte
+
+	// Delete marks a signed request to replace the entry with a tombstone.
+	Delete bool
+
+	// The write is accepted only if the stored version of the entry equals
+	// ExpectedVersion (0 - the entry does not exist).
+	HasExpectedVersion bool
+	ExpectedVersion    uint64
+
+	// TTL asks the server to drop the entry after this period, 0 - use
+	// the server default. Whole seconds only.
+	TTL time.Duration
+
+	// LegacyTime marks a v1 frame without a time zone entry: its time may
+	// be the local time of the writer rather than UTC.
+	LegacyTime bool
+
+	// Entries holds all archive entries of a v1 frame.
+	Entries map[string][]byte
+}
+
+func (f *Frame) AddressHex() string {
+	return "0x" + hex.EncodeToString(f.Address)
+}
+
+// Bytes returns the frame in the wire format.
+func (f *Frame) Bytes() []byte {
+	bs := make([]byte, HeaderSize+len(f.Payload))
+	copy(bs[:AddressSize], f.Address)
+	copy(bs[AddressSize:HeaderSize], f.Signature)
+	copy(bs[HeaderSize:], f.Payload)
+	return bs
+}
+
+// Encode builds the payload in the format selected by f.Version (v1 by
+// default), signs it and returns the frame in the wire format.
+func Encode(privateKey ed25519.PrivateKey, f *Frame) ([]byte, error) {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return nil, ErrNoPrivateKey
+	}
+	var err error
+	switch f.Version {
+	case 0, Version1:
+		f.Version = Version1
+		f.Payload, err = encodeV1(f)
+	case Version2:
+		f.Payload, err = encodeV2(f)
+	default:
+		err = ErrBadVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Address = []byte(privateKey.Public().(ed25519.PublicKey))
+	f.Signature = ed25519.Sign(privateKey, f.Payload)
+	return f.Bytes(), nil
+}
+
+// Decode splits the frame and decodes its payload. The signature is not
+// checked; use Verify for untrusted input.
+func Decode(bs []byte) (*Frame, error) {
+	if len(bs) < HeaderSize {
+		return nil, ErrTooShort
+	}
+	f, err := DecodePayload(bs[HeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	f.Address = bs[:AddressSize]
+	f.Signature = bs[AddressSize:HeaderSize]
+	return f, nil
+}
+
+// Verify decodes the frame and checks its signature.
+func Verify(bs []byte) (*Frame, error) {
+	if len(bs) < HeaderSize {
+		return nil, ErrTooShort
+	}
+	if len(bs)-HeaderSize > MaxPayloadLen {
+		return nil, ErrTooLarge
+	}
+	if !ed25519.Verify(bs[:AddressSize], bs[HeaderSize:], bs[AddressSize:HeaderSize]) {
+		return nil, ErrBadSignature
+	}
+	return Decode(bs)
+}
+
+// DecodePayload decodes an unsigned payload of any supported version.
+func DecodePayload(payload []byte) (*Frame, error) {
+	if len(payload) > MaxPayloadLen {
+		return nil, ErrTooLarge
+	}
+	if len(payload) == 0 {
+		return nil, ErrTooShort
+	}
+	if payload[0] == Version2 {
+		return decodeV2(payload)
+	}
+	return decodeV1(payload)
+}
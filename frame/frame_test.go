@@ -0,0 +1,383 @@
+package frame
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPrivateKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+
+var testTime = time.Date(2024, 5, 6, 7, 8, 9, 123000000, time.UTC)
+
+type zipEntry struct {
+	name  string
+	value []byte
+}
+
+func makeZip(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for _, entry := range entries {
+		w, err := zipWriter.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.value)
+	}
+	err := zipWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeRawZip stores a deflated entry whose header declares the given
+// uncompressed size.
+func makeRawZip(t *testing.T, name string, value []byte, declaredSize uint64) []byte {
+	t.Helper()
+	compressed := new(bytes.Buffer)
+	w, _ := flate.NewWriter(compressed, flate.BestCompression)
+	w.Write(value)
+	w.Close()
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for _, entry := range []zipEntry{{EntryName, []byte("n")}, {EntryTime, []byte(testTime.Format(TimeFormat))}} {
+		fw, _ := zipWriter.Create(entry.name)
+		fw.Write(entry.value)
+	}
+	fw, err := zipWriter.CreateRaw(&zip.FileHeader{
+		Name:               name,
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(value),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: declaredSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(compressed.Bytes())
+	zipWriter.Close()
+	return buf.Bytes()
+}
+
+func baseEntries() []zipEntry {
+	return []zipEntry{
+		{EntryValue, []byte("v")},
+		{EntryName, []byte("n")},
+		{EntryTime, []byte(testTime.Format(TimeFormat))},
+	}
+}
+
+func expectError(t *testing.T, name string, err error, expected *Error) {
+	t.Helper()
+	if !errors.Is(err, expected) {
+		t.Fatalf("%s: expected %s, got %v", name, expected.Code, err)
+	}
+	var frameErr *Error
+	if !errors.As(err, &frameErr) || frameErr.Code != expected.Code {
+		t.Fatalf("%s: expected code %s, got %v", name, expected.Code, err)
+	}
+}
+
+func TestV1RoundTrip(t *testing.T) {
+	bs, err := Encode(testPrivateKey, &Frame{
+		Name:               "temperature",
+		Value:              []byte("21.5"),
+		Time:               testTime,
+		HasExpectedVersion: true,
+		ExpectedVersion:    3,
+		TTL:                time.Hour,
+		Entries:            map[string][]byte{"unit": []byte("C")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Verify(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != Version1 || f.Name != "temperature" || string(f.Value) != "21.5" {
+		t.Fatal("unexpected frame:", f.Version, f.Name, string(f.Value))
+	}
+	if !f.Time.Equal(testTime) || f.LegacyTime {
+		t.Fatal("unexpected time:", f.Time, f.LegacyTime)
+	}
+	if !f.HasExpectedVersion || f.ExpectedVersion != 3 || f.TTL != time.Hour {
+		t.Fatal("unexpected options:", f.ExpectedVersion, f.TTL)
+	}
+	if string(f.Entries["unit"]) != "C" {
+		t.Fatal("extra entry lost")
+	}
+	if !bytes.Equal(f.Address, testPrivateKey.Public().(ed25519.PublicKey)) {
+		t.Fatal("unexpected address")
+	}
+	if !bytes.Equal(f.Bytes(), bs) {
+		t.Fatal("Bytes does not restore the frame")
+	}
+
+	bs, err = Encode(testPrivateKey, &Frame{Name: "temperature", Time: testTime, Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = Verify(bs)
+	if err != nil || !f.Delete {
+		t.Fatal("delete frame:", err)
+	}
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	for _, flags := range []byte{0, FlagDeflate} {
+		bs, err := Encode(testPrivateKey, &Frame{
+			Version:            Version2,
+			Name:               "temperature",
+			Value:              []byte(strings.Repeat("21.5 ", 100)),
+			Time:               testTime,
+			Seq:                42,
+			ContentType:        ContentTypeJSON,
+			Flags:              flags,
+			Delete:             true,
+			HasExpectedVersion: true,
+			ExpectedVersion:    3,
+			TTL:                time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Verify(bs)
+		if err != nil {
+			t.Fatal(flags, err)
+		}
+		if f.Version != Version2 || f.Name != "temperature" || string(f.Value) != strings.Repeat("21.5 ", 100) {
+			t.Fatal(flags, "unexpected frame:", f.Version, f.Name)
+		}
+		if !f.Time.Equal(testTime) || f.Seq != 42 || f.ContentType != ContentTypeJSON || !f.Delete {
+			t.Fatal(flags, "unexpected header:", f.Time, f.Seq, f.ContentType, f.Delete)
+		}
+		if !f.HasExpectedVersion || f.ExpectedVersion != 3 || f.TTL != time.Hour {
+			t.Fatal(flags, "unexpected options:", f.ExpectedVersion, f.TTL)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	bs, err := Encode(testPrivateKey, &Frame{Name: "n", Value: []byte("v"), Time: testTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[len(bs)-1] ^= 0xff
+	_, err = Verify(bs)
+	expectError(t, "tampered", err, ErrBadSignature)
+
+	_, err = Verify(bs[:HeaderSize-1])
+	expectError(t, "short", err, ErrTooShort)
+
+	_, err = Verify(make([]byte, HeaderSize+MaxPayloadLen+1))
+	expectError(t, "large", err, ErrTooLarge)
+
+	_, err = Encode(nil, &Frame{Name: "n"})
+	expectError(t, "no key", err, ErrNoPrivateKey)
+
+	_, err = Encode(testPrivateKey, &Frame{Version: 3, Name: "n"})
+	expectError(t, "version", err, ErrBadVersion)
+}
+
+func TestV1LegacyTime(t *testing.T) {
+	f, err := DecodePayload(makeZip(t, baseEntries()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.LegacyTime {
+		t.Fatal("a frame without a time zone must be LegacyTime")
+	}
+
+	_, err = DecodePayload(makeZip(t, append(baseEntries(), zipEntry{EntryTimeZone, []byte("CET")})...))
+	expectError(t, "zone", err, ErrBadTime)
+
+	entries := baseEntries()
+	entries[2].value = []byte("yesterday")
+	_, err = DecodePayload(makeZip(t, entries...))
+	expectError(t, "time", err, ErrBadTime)
+}
+
+func TestV1Entries(t *testing.T) {
+	_, err := DecodePayload([]byte("not an archive"))
+	expectError(t, "archive", err, ErrBadArchive)
+
+	for i := range baseEntries() {
+		entries := baseEntries()
+		missing := entries[i].name
+		entries = append(entries[:i], entries[i+1:]...)
+		_, err = DecodePayload(makeZip(t, entries...))
+		expectError(t, "missing "+missing, err, ErrMissingEntry)
+	}
+
+	_, err = DecodePayload(makeZip(t, append(baseEntries(), zipEntry{EntryValue, []byte("w")})...))
+	expectError(t, "duplicate", err, ErrDuplicateEntry)
+
+	entries := baseEntries()
+	for i := len(entries); i <= MaxEntries; i++ {
+		entries = append(entries, zipEntry{"extra" + string(rune('a'+i)), nil})
+	}
+	_, err = DecodePayload(makeZip(t, entries...))
+	expectError(t, "too many", err, ErrTooManyEntries)
+
+	_, err = DecodePayload(makeZip(t, append(baseEntries(), zipEntry{EntryOp, []byte("drop")})...))
+	expectError(t, "op", err, ErrBadOp)
+
+	_, err = DecodePayload(makeZip(t, append(baseEntries(), zipEntry{EntryTTL, []byte("-1")})...))
+	expectError(t, "ttl", err, ErrBadEntry)
+}
+
+func TestV1SizeCaps(t *testing.T) {
+	entries := baseEntries()
+	entries[0].value = make([]byte, MaxDataSize)
+	_, err := DecodePayload(makeZip(t, entries...))
+	expectError(t, "total", err, ErrTooLarge)
+
+	entries = baseEntries()
+	entries[1].value = make([]byte, MaxNameSize+1)
+	_, err = DecodePayload(makeZip(t, entries...))
+	expectError(t, "name", err, ErrEntryTooLarge)
+
+	_, err = Encode(testPrivateKey, &Frame{Name: "n", Value: make([]byte, MaxDataSize+1), Time: testTime})
+	expectError(t, "encode", err, ErrEntryTooLarge)
+
+	_, err = DecodePayload(make([]byte, MaxPayloadLen+1))
+	expectError(t, "payload", err, ErrTooLarge)
+}
+
+func TestV1ZipBomb(t *testing.T) {
+	bomb := make([]byte, 1024*1024)
+
+	// An honest header is refused before anything is inflated.
+	_, err := DecodePayload(makeRawZip(t, EntryValue, bomb, uint64(len(bomb))))
+	expectError(t, "bomb", err, ErrEntryTooLarge)
+
+	// A header that understates the size is caught while reading.
+	_, err = DecodePayload(makeRawZip(t, EntryValue, bomb, 10))
+	expectError(t, "lying bomb", err, ErrBadArchive)
+
+	// So is an entry that fits the limit but not its declared size.
+	_, err = DecodePayload(makeRawZip(t, EntryValue, make([]byte, 100), 1))
+	expectError(t, "lying entry", err, ErrBadArchive)
+}
+
+func makeV2(flags byte, body []byte) []byte {
+	payload := make([]byte, v2HeaderSize)
+	payload[0] = Version2
+	binary.BigEndian.PutUint64(payload[1:], uint64(testTime.UnixNano()))
+	payload[18] = flags
+	if flags&FlagDeflate != 0 {
+		buf := new(bytes.Buffer)
+		w, _ := flate.NewWriter(buf, flate.BestCompression)
+		w.Write(body)
+		w.Close()
+		body = buf.Bytes()
+	}
+	return append(payload, body...)
+}
+
+func tlv(tag byte, value []byte) []byte {
+	buf := new(bytes.Buffer)
+	writeTLV(buf, tag, value)
+	return buf.Bytes()
+}
+
+// Every option counts towards the size limit in both directions.
+func TestV2SizeLimit(t *testing.T) {
+	for _, flags := range []byte{0, FlagDeflate} {
+		f := Frame{
+			Version:            Version2,
+			Name:               "n",
+			Time:               testTime,
+			Flags:              flags,
+			HasExpectedVersion: true,
+			ExpectedVersion:    1,
+			TTL:                time.Hour,
+		}
+		f.Value = make([]byte, MaxDataSize-len(f.Name)-8-4)
+		bs, err := Encode(testPrivateKey, &f)
+		if err != nil {
+			t.Fatal(flags, err)
+		}
+		decoded, err := Verify(bs)
+		if err != nil {
+			t.Fatal(flags, "frame at the limit:", err)
+		}
+		if len(decoded.Value) != len(f.Value) || decoded.TTL != time.Hour {
+			t.Fatal(flags, "unexpected frame at the limit")
+		}
+
+		f.Value = append(f.Value, 0)
+		_, err = Encode(testPrivateKey, &f)
+		expectError(t, "over the limit", err, ErrTooLarge)
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	name := tlv(TagName, []byte("n"))
+	value := tlv(TagValue, []byte("v"))
+
+	_, err := DecodePayload(makeV2(0, nil)[:v2HeaderSize-1])
+	expectError(t, "short", err, ErrTooShort)
+
+	_, err = DecodePayload(makeV2(0, name))
+	expectError(t, "missing value", err, ErrMissingEntry)
+
+	_, err = DecodePayload(makeV2(0, value))
+	expectError(t, "missing name", err, ErrMissingEntry)
+
+	_, err = DecodePayload(makeV2(0, join(name, value, name)))
+	expectError(t, "duplicate", err, ErrDuplicateEntry)
+
+	_, err = DecodePayload(makeV2(0, join(name, value, tlv(0x7f, nil))))
+	expectError(t, "tag", err, ErrUnknownTag)
+
+	_, err = DecodePayload(makeV2(0, join(name, value, tlv(TagTTL, []byte{1}))))
+	expectError(t, "ttl", err, ErrBadEntry)
+
+	_, err = DecodePayload(makeV2(0, join(name, value[:len(value)-1])))
+	expectError(t, "truncated", err, ErrBadBody)
+
+	_, err = DecodePayload(append(makeV2(0, nil)[:v2HeaderSize-1], FlagDeflate, 0xff, 0xff))
+	expectError(t, "deflate", err, ErrBadBody)
+
+	_, err = DecodePayload(makeV2(0, join(tlv(TagName, make([]byte, MaxNameSize+1)), value)))
+	expectError(t, "name size", err, ErrEntryTooLarge)
+
+	_, err = Encode(testPrivateKey, &Frame{Version: Version2, Name: "n", Value: make([]byte, MaxDataSize), Time: testTime})
+	expectError(t, "encode", err, ErrTooLarge)
+
+	for _, tm := range []time.Time{{}, time.Unix(0, math.MinInt64).Add(-time.Nanosecond), time.Unix(0, math.MaxInt64).Add(time.Nanosecond)} {
+		_, err = Encode(testPrivateKey, &Frame{Version: Version2, Name: "n", Time: tm})
+		expectError(t, "time "+tm.String(), err, ErrBadTime)
+	}
+	_, err = Encode(testPrivateKey, &Frame{Version: Version2, Name: "n", Time: time.Unix(0, math.MaxInt64)})
+	if err != nil {
+		t.Fatal("latest time:", err)
+	}
+}
+
+func TestV2DeflateBomb(t *testing.T) {
+	body := join(tlv(TagName, []byte("n")))
+	for len(body) < 1024*1024 {
+		body = append(body, tlv(0x7f, make([]byte, 60000))...)
+	}
+	_, err := DecodePayload(makeV2(FlagDeflate, body))
+	expectError(t, "bomb", err, ErrTooLarge)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,196 @@
+package frame
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	EntryValue = "value"
+	EntryName  = "name"
+	EntryTime  = "time"
+	EntryOp    = "op"
+
+	EntryExpectedVersion = "expected_version"
+	EntryTTL             = "ttl"
+
+	// EntryTimeZone marks the zone of the time entry. Early clients wrote
+	// their local time without it; such frames are decoded as LegacyTime.
+	EntryTimeZone = "time_zone"
+	TimeZoneUTC   = "UTC"
+)
+
+const OpDelete = "delete"
+
+func encodeV1(f *Frame) ([]byte, error) {
+	entries := map[string][]byte{
+		EntryValue: f.Value,
+		EntryName:  []byte(f.Name),
+		EntryTime:  []byte(f.Time.UTC().Format(TimeFormat)),
+
+		EntryTimeZone: []byte(TimeZoneUTC),
+	}
+	order := []string{EntryValue, EntryName, EntryTime, EntryTimeZone}
+	if f.Delete {
+		entries[EntryOp] = []byte(OpDelete)
+		order = append(order, EntryOp)
+	}
+	if f.HasExpectedVersion {
+		entries[EntryExpectedVersion] = []byte(strconv.FormatUint(f.ExpectedVersion, 10))
+		order = append(order, EntryExpectedVersion)
+	}
+	if f.TTL > 0 {
+		entries[EntryTTL] = []byte(strconv.FormatInt(int64(f.TTL/time.Second), 10))
+		order = append(order, EntryTTL)
+	}
+	extra := make([]string, 0, len(f.Entries))
+	for name := range f.Entries {
+		if _, exists := entries[name]; !exists {
+			extra = append(extra, name)
+		}
+	}
+	slices.Sort(extra)
+	for _, name := range extra {
+		entries[name] = f.Entries[name]
+	}
+	order = append(order, extra...)
+	err := checkEntries(order, func(name string) int64 { return int64(len(entries[name])) })
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	for _, name := range order {
+		zipFile, err := zipWriter.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = zipFile.Write(entries[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	f.Entries = entries
+	return buf.Bytes(), nil
+}
+
+func decodeV1(payload []byte) (*Frame, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+	if err != nil {
+		return nil, ErrBadArchive
+	}
+
+	order := make([]string, 0, len(zipReader.File))
+	sizes := make(map[string]int64)
+	for _, file := range zipReader.File {
+		order = append(order, file.Name)
+		sizes[file.Name] = int64(file.UncompressedSize64)
+	}
+	err = checkEntries(order, func(name string) int64 { return sizes[name] })
+	if err != nil {
+		return nil, err
+	}
+
+	var f Frame
+	f.Version = Version1
+	f.Payload = payload
+	f.Entries = make(map[string][]byte)
+	total := int64(0)
+	for _, file := range zipReader.File {
+		// The declared sizes are not trusted: read at most one byte
+		// over the limit to detect archives that lie about them.
+		rc, err := file.Open()
+		if err != nil {
+			return nil, ErrBadArchive
+		}
+		bs, err := io.ReadAll(io.LimitReader(rc, MaxDataSize+1))
+		rc.Close()
+		if err != nil {
+			return nil, ErrBadArchive
+		}
+		if len(bs) > MaxDataSize {
+			return nil, fmt.Errorf("%w: %s", ErrEntryTooLarge, file.Name)
+		}
+		total += int64(len(bs))
+		if total > MaxDataSize {
+			return nil, ErrTooLarge
+		}
+		f.Entries[file.Name] = bs
+	}
+
+	f.Value = f.Entries[EntryValue]
+	f.Name = string(f.Entries[EntryName])
+	f.Time, err = time.Parse(TimeFormat, string(f.Entries[EntryTime]))
+	if err != nil {
+		return nil, ErrBadTime
+	}
+	if zone, exists := f.Entries[EntryTimeZone]; exists {
+		if string(zone) != TimeZoneUTC {
+			return nil, ErrBadTime
+		}
+	} else {
+		f.LegacyTime = true
+	}
+	if op, exists := f.Entries[EntryOp]; exists {
+		if string(op) != OpDelete {
+			return nil, ErrBadOp
+		}
+		f.Delete = true
+	}
+	if expected, exists := f.Entries[EntryExpectedVersion]; exists {
+		f.ExpectedVersion, err = strconv.ParseUint(string(expected), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadEntry, EntryExpectedVersion)
+		}
+		f.HasExpectedVersion = true
+	}
+	if ttl, exists := f.Entries[EntryTTL]; exists {
+		seconds, err := strconv.ParseUint(string(ttl), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadEntry, EntryTTL)
+		}
+		f.TTL = time.Duration(seconds) * time.Second
+	}
+	return &f, nil
+}
+
+func checkEntries(order []string, size func(name string) int64) error {
+	if len(order) > MaxEntries {
+		return ErrTooManyEntries
+	}
+	seen := make(map[string]bool)
+	total := int64(0)
+	for _, name := range order {
+		if seen[name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateEntry, name)
+		}
+		seen[name] = true
+		s := size(name)
+		if s > MaxDataSize {
+			return fmt.Errorf("%w: %s", ErrEntryTooLarge, name)
+		}
+		total += s
+	}
+	if total > MaxDataSize {
+		return ErrTooLarge
+	}
+	for _, name := range []string{EntryValue, EntryName, EntryTime} {
+		if !seen[name] {
+			return fmt.Errorf("%w: %s", ErrMissingEntry, name)
+		}
+	}
+	if size(EntryName) > MaxNameSize {
+		return fmt.Errorf("%w: %s", ErrEntryTooLarge, EntryName)
+	}
+	return nil
+}
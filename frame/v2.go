@@ -0,0 +1,216 @@
+package frame
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// v2 payload layout, big endian:
+//
+//	[0]     version, always 2
+//	[1:9]   time, unix nanoseconds
+//	[9:17]  sequence number
+//	[17]    content type
+//	[18]    flags
+//	[19:]   body, deflate-compressed if FlagDeflate is set
+//
+// The body is a sequence of TLV records: [tag 1][length 2][value].
+const (
+	v2HeaderSize = 19
+	tlvHeaderLen = 3
+	maxV2Body    = MaxDataSize + MaxEntries*tlvHeaderLen
+)
+
+// The range of the time field; the zero Time is outside of it.
+var (
+	minV2Time = time.Unix(0, math.MinInt64)
+	maxV2Time = time.Unix(0, math.MaxInt64)
+)
+
+const (
+	TagName            = 0x01
+	TagValue           = 0x02
+	TagExpectedVersion = 0x03
+	TagTTL             = 0x04
+)
+
+func encodeV2(f *Frame) ([]byte, error) {
+	if f.Time.Before(minV2Time) || f.Time.After(maxV2Time) {
+		return nil, fmt.Errorf("%w: %v is out of the unix nanosecond range", ErrBadTime, f.Time)
+	}
+	if len(f.Name) > MaxNameSize {
+		return nil, fmt.Errorf("%w: name", ErrEntryTooLarge)
+	}
+	records := []tlvRecord{
+		{TagName, []byte(f.Name)},
+		{TagValue, f.Value},
+	}
+	if f.HasExpectedVersion {
+		records = append(records, tlvRecord{TagExpectedVersion, binary.BigEndian.AppendUint64(nil, f.ExpectedVersion)})
+	}
+	if f.TTL > 0 {
+		records = append(records, tlvRecord{TagTTL, binary.BigEndian.AppendUint32(nil, uint32(f.TTL/time.Second))})
+	}
+	err := checkRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	body := new(bytes.Buffer)
+	for _, rec := range records {
+		writeTLV(body, rec.tag, rec.value)
+	}
+
+	payload := new(bytes.Buffer)
+	header := make([]byte, v2HeaderSize)
+	header[0] = Version2
+	binary.BigEndian.PutUint64(header[1:], uint64(f.Time.UnixNano()))
+	binary.BigEndian.PutUint64(header[9:], f.Seq)
+	header[17] = f.ContentType
+	header[18] = f.Flags
+	if f.Delete {
+		header[18] |= FlagDelete
+	}
+	payload.Write(header)
+
+	if f.Flags&FlagDeflate != 0 {
+		w, err := flate.NewWriter(payload, flate.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(body.Bytes())
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		payload.Write(body.Bytes())
+	}
+	return payload.Bytes(), nil
+}
+
+type tlvRecord struct {
+	tag   byte
+	value []byte
+}
+
+// checkRecords applies the limits of a v2 body: the number of records,
+// unique tags and the total size of all values. The encoder and the
+// decoder share it, so every encoded frame can be decoded.
+func checkRecords(records []tlvRecord) error {
+	if len(records) > MaxEntries {
+		return ErrTooManyEntries
+	}
+	seen := make(map[byte]bool)
+	total := 0
+	for _, rec := range records {
+		if seen[rec.tag] {
+			return fmt.Errorf("%w: tag %d", ErrDuplicateEntry, rec.tag)
+		}
+		seen[rec.tag] = true
+		total += len(rec.value)
+	}
+	if total > MaxDataSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func writeTLV(w *bytes.Buffer, tag byte, value []byte) {
+	header := make([]byte, tlvHeaderLen)
+	header[0] = tag
+	binary.BigEndian.PutUint16(header[1:], uint16(len(value)))
+	w.Write(header)
+	w.Write(value)
+}
+
+func decodeV2(payload []byte) (*Frame, error) {
+	if len(payload) < v2HeaderSize {
+		return nil, ErrTooShort
+	}
+
+	var f Frame
+	f.Version = Version2
+	f.Payload = payload
+	f.Time = time.Unix(0, int64(binary.BigEndian.Uint64(payload[1:]))).UTC()
+	f.Seq = binary.BigEndian.Uint64(payload[9:])
+	f.ContentType = payload[17]
+	f.Flags = payload[18]
+	f.Delete = f.Flags&FlagDelete != 0
+
+	body := payload[v2HeaderSize:]
+	if f.Flags&FlagDeflate != 0 {
+		r := flate.NewReader(bytes.NewReader(body))
+		bs, err := io.ReadAll(io.LimitReader(r, maxV2Body+1))
+		r.Close()
+		if err != nil {
+			return nil, ErrBadBody
+		}
+		body = bs
+	}
+	if len(body) > maxV2Body {
+		return nil, ErrTooLarge
+	}
+
+	records := make([]tlvRecord, 0)
+	for len(body) > 0 {
+		if len(body) < tlvHeaderLen {
+			return nil, ErrBadBody
+		}
+		tag := body[0]
+		size := int(binary.BigEndian.Uint16(body[1:]))
+		body = body[tlvHeaderLen:]
+		if size > len(body) {
+			return nil, ErrBadBody
+		}
+		records = append(records, tlvRecord{tag, body[:size]})
+		body = body[size:]
+	}
+	err := checkRecords(records)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[byte][]byte)
+	for _, rec := range records {
+		tags[rec.tag] = rec.value
+	}
+
+	for tag, value := range tags {
+		switch tag {
+		case TagName:
+			if len(value) > MaxNameSize {
+				return nil, fmt.Errorf("%w: name", ErrEntryTooLarge)
+			}
+			f.Name = string(value)
+		case TagValue:
+			f.Value = value
+		case TagExpectedVersion:
+			if len(value) != 8 {
+				return nil, fmt.Errorf("%w: expected version", ErrBadEntry)
+			}
+			f.ExpectedVersion = binary.BigEndian.Uint64(value)
+			f.HasExpectedVersion = true
+		case TagTTL:
+			if len(value) != 4 {
+				return nil, fmt.Errorf("%w: ttl", ErrBadEntry)
+			}
+			f.TTL = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		default:
+			return nil, fmt.Errorf("%w: %d", ErrUnknownTag, tag)
+		}
+	}
+	if _, exists := tags[TagName]; !exists {
+		return nil, fmt.Errorf("%w: name", ErrMissingEntry)
+	}
+	if _, exists := tags[TagValue]; !exists {
+		return nil, fmt.Errorf("%w: value", ErrMissingEntry)
+	}
+	return &f, nil
+}
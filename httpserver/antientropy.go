@@ -0,0 +1,365 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+)
+
+// Anti-entropy compares the content of two nodes by ranges of addresses.
+// A range is a prefix of the hex address; its digest is the XOR of the
+// hashes of its entries, so it does not depend on the order of the
+// entries. Ranges that differ are split into 16 subranges until they hold
+// few enough entries to be compared one by one.
+const (
+	digestLeafSize  = 32
+	maxRangePrefix  = frame.AddressSize * 2
+	syncFramesBatch = 100
+)
+
+type RangeDigest struct {
+	Prefix string `json:"prefix"`
+	Hash   []byte `json:"hash"`
+	Count  int    `json:"count"`
+}
+
+type DigestRequest struct {
+	Prefix string `json:"prefix"`
+}
+
+type DigestResult struct {
+	Ranges []RangeDigest `json:"ranges"`
+}
+
+type EntryDigest struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	Seq     uint64    `json:"seq,omitempty"`
+}
+
+type EntriesResult struct {
+	Entries []EntryDigest `json:"entries"`
+}
+
+type FramesRequest struct {
+	Entries []EntryDigest `json:"entries"`
+}
+
+type FramesResult struct {
+	Frames [][]byte `json:"frames"`
+}
+
+type peerSync struct {
+	url       string
+	lastSync  time.Time
+	lastRun   int
+	repaired  int64
+	lastError string
+}
+
+type AntiEntropy struct {
+	mtx      sync.Mutex
+	peers    []*peerSync
+	interval time.Duration
+	client   *http.Client
+}
+
+func NewAntiEntropy(config Config) *AntiEntropy {
+	var c AntiEntropy
+	c.interval = time.Duration(config.AntiEntropyIntervalSec) * time.Second
+	c.client = &http.Client{Timeout: 10 * time.Second}
+	return &c
+}
+
+var antiEntropy = NewAntiEntropy(DefaultConfig())
+
+func (c *AntiEntropy) Start() {
+	if c.interval <= 0 {
+		return
+	}
+	go c.thSync()
+}
+
+// peer returns the sync state of the peer, keeping only the current
+// peers of the cluster.
+func (c *AntiEntropy) peer(peerUrl string) *peerSync {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	current := cluster.Peers()
+	c.peers = slices.DeleteFunc(c.peers, func(peer *peerSync) bool {
+		return !slices.Contains(current, peer.url)
+	})
+	for _, peer := range c.peers {
+		if peer.url == peerUrl {
+			return peer
+		}
+	}
+	peer := &peerSync{url: peerUrl}
+	c.peers = append(c.peers, peer)
+	return peer
+}
+
+func (c *AntiEntropy) thSync() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.SyncAll()
+		<-ticker.C
+	}
+}
+
+// SyncAll pulls the missing and newer entries from every peer.
+func (c *AntiEntropy) SyncAll() {
+	for _, peerUrl := range cluster.Peers() {
+		peer := c.peer(peerUrl)
+		repaired, err := c.syncRange(peer.url, "")
+		c.mtx.Lock()
+		peer.lastRun = repaired
+		peer.repaired += int64(repaired)
+		if err != nil {
+			peer.lastError = err.Error()
+		} else {
+			peer.lastSync = time.Now()
+			peer.lastError = ""
+		}
+		c.mtx.Unlock()
+		if err != nil {
+			logger.Println("AntiEntropy sync with", peer.url, "error:", err)
+		} else if repaired > 0 {
+			logger.Println("AntiEntropy sync with", peer.url, "repaired", repaired, "entries")
+		}
+	}
+}
+
+func (c *AntiEntropy) syncRange(peerUrl string, prefix string) (int, error) {
+	var remote DigestResult
+	err := c.call(peerUrl, "/peer/digest", DigestRequest{Prefix: prefix}, &remote)
+	if err != nil {
+		return 0, err
+	}
+	local := make(map[string]RangeDigest)
+	for _, r := range storage.rangeDigests(prefix) {
+		local[r.Prefix] = r
+	}
+
+	repaired := 0
+	for _, r := range remote.Ranges {
+		if prefix == "" && !cluster.OwnsRange(r.Prefix) {
+			continue
+		}
+		l := local[r.Prefix]
+		if l.Count == r.Count && bytes.Equal(l.Hash, r.Hash) {
+			continue
+		}
+		var n int
+		if r.Count <= digestLeafSize || len(r.Prefix) >= maxRangePrefix {
+			n, err = c.syncEntries(peerUrl, r.Prefix)
+		} else {
+			n, err = c.syncRange(peerUrl, r.Prefix)
+		}
+		repaired += n
+		if err != nil {
+			return repaired, err
+		}
+	}
+	return repaired, nil
+}
+
+func (c *AntiEntropy) syncEntries(peerUrl string, prefix string) (int, error) {
+	var remote EntriesResult
+	err := c.call(peerUrl, "/peer/entries", DigestRequest{Prefix: prefix}, &remote)
+	if err != nil {
+		return 0, err
+	}
+	missing := storage.missingEntries(remote.Entries)
+
+	repaired := 0
+	for len(missing) > 0 {
+		batch := missing[:min(len(missing), syncFramesBatch)]
+		missing = missing[len(batch):]
+		var frames FramesResult
+		err = c.call(peerUrl, "/peer/frames", FramesRequest{Entries: batch}, &frames)
+		if err != nil {
+			return repaired, err
+		}
+		for _, frameBS := range frames.Frames {
+			// setData verifies the signature before storing.
+			_, err := setData(frameBS, true)
+			if err != nil {
+				if !errors.Is(err, ErrStaleFrame) {
+					logger.Println("AntiEntropy frame from", peerUrl, "rejected:", err)
+				}
+				continue
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+func (c *AntiEntropy) call(peerUrl string, path string, req any, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := c.client.Post(peerUrl+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	respBS, err := io.ReadAll(io.LimitReader(r.Body, maxPeerBodySize))
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return errors.New("peer returned status " + r.Status + ": " + string(respBS))
+	}
+	return json.Unmarshal(respBS, resp)
+}
+
+func (c *AntiEntropy) BuildDebugInfo() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	info := "Anti-entropy Debug Info:\n"
+	for _, peer := range c.peers {
+		lastSync := "never"
+		if !peer.lastSync.IsZero() {
+			lastSync = peer.lastSync.UTC().Format("2006-01-02 15:04:05.000")
+		}
+		info += fmt.Sprintf("  Peer: %s, Last sync: %s, Repaired: %d, Last run: %d",
+			peer.url, lastSync, peer.repaired, peer.lastRun)
+		if peer.lastError != "" {
+			info += ", Last error: " + peer.lastError
+		}
+		info += "\n"
+	}
+	return info
+}
+
+// syncItem returns the item of the entry that takes part in anti-entropy:
+// the latest one, including tombstones, unless it has expired.
+func syncItem(entry *Entry, now time.Time) *Item {
+	item := entry.Latest()
+	if item == nil || item.Expired(now) {
+		return nil
+	}
+	return item
+}
+
+func entryHash(entry *Entry, item *Item) []byte {
+	h := sha256.New()
+	h.Write([]byte(entryKey(entry.Address, entry.Name)))
+	h.Write(item.Signature)
+	return h.Sum(nil)
+}
+
+// rangeDigests returns the digests of the non-empty subranges of the
+// prefix.
+func (c *Storage) rangeDigests(prefix string) []RangeDigest {
+	if len(prefix) >= maxRangePrefix {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	byPrefix := make(map[string]*RangeDigest)
+	for _, entry := range c.items {
+		address := strings.TrimPrefix(entry.Address, "0x")
+		item := syncItem(entry, now)
+		if item == nil || !strings.HasPrefix(address, prefix) {
+			continue
+		}
+		sub := address[:len(prefix)+1]
+		r, exists := byPrefix[sub]
+		if !exists {
+			r = &RangeDigest{Prefix: sub, Hash: make([]byte, sha256.Size)}
+			byPrefix[sub] = r
+		}
+		for i, b := range entryHash(entry, item) {
+			r.Hash[i] ^= b
+		}
+		r.Count++
+	}
+	result := make([]RangeDigest, 0, len(byPrefix))
+	for _, digit := range "0123456789abcdef" {
+		sub := prefix + string(digit)
+		if r, exists := byPrefix[sub]; exists {
+			result = append(result, *r)
+		}
+	}
+	return result
+}
+
+func (c *Storage) rangeEntries(prefix string) []EntryDigest {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	result := make([]EntryDigest, 0)
+	for _, entry := range c.items {
+		item := syncItem(entry, now)
+		if item == nil || !strings.HasPrefix(strings.TrimPrefix(entry.Address, "0x"), prefix) {
+			continue
+		}
+		result = append(result, EntryDigest{
+			Address: entry.Address,
+			Name:    entry.Name,
+			Time:    item.Time,
+			Seq:     item.Seq,
+		})
+	}
+	return result
+}
+
+// missingEntries returns the entries of a peer that the node owns and
+// that are absent here or older than the peer's.
+func (c *Storage) missingEntries(entries []EntryDigest) []EntryDigest {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	result := make([]EntryDigest, 0)
+	for _, e := range entries {
+		if !cluster.Owns(e.Address) {
+			continue
+		}
+		entry, exists := c.items[entryKey(e.Address, e.Name)]
+		if exists {
+			remote := Item{Time: e.Time, Seq: e.Seq}
+			if !remote.NewerThan(entry.Latest()) {
+				continue
+			}
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func (c *Storage) entryFrames(entries []EntryDigest) [][]byte {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	result := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		entry, exists := c.items[entryKey(e.Address, e.Name)]
+		if !exists {
+			continue
+		}
+		item := syncItem(entry, now)
+		if item == nil {
+			continue
+		}
+		f := frame.Frame{Address: item.Address, Signature: item.Signature, Payload: item.Data}
+		result = append(result, f.Bytes())
+	}
+	return result
+}
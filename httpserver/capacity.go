@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+func itemSize(item *Item) int64 {
+	return int64(len(item.Address) + len(item.Data) + len(item.Signature))
+}
+
+// admit checks that the item may be stored under the key and frees space
+// for it according to the eviction policy. Must be called under c.mtx.
+func (c *Storage) admit(key string, item *Item) error {
+	entry, exists := c.items[key]
+	growth := itemSize(item)
+	if exists {
+		if latest := entry.Latest(); latest != nil && !item.NewerThan(latest) {
+			return ErrStaleFrame
+		}
+		if len(entry.History) >= MaxHistorySize {
+			growth -= itemSize(entry.History[len(entry.History)-1])
+		}
+	} else if rec, expired := c.expired[key]; expired && !item.Time.After(rec.Time) {
+		return ErrStaleFrame
+	}
+
+	if c.config.MaxTotalBytes > 0 && growth > c.config.MaxTotalBytes {
+		c.refusals++
+		return ErrStorageFull
+	}
+
+	for c.overLimit(!exists, growth) {
+		if !exists && c.config.PreferKnown {
+			c.refusals++
+			return ErrStorageFull
+		}
+		if !c.evict(key) {
+			c.refusals++
+			return ErrStorageFull
+		}
+	}
+	return nil
+}
+
+func (c *Storage) overLimit(newEntry bool, growth int64) bool {
+	if newEntry && c.config.MaxEntries > 0 && len(c.items) >= c.config.MaxEntries {
+		return true
+	}
+	if c.config.MaxTotalBytes > 0 && c.totalBytes+growth > c.config.MaxTotalBytes {
+		return true
+	}
+	return false
+}
+
+// evict removes one entry other than exclude. Returns false if nothing
+// can be evicted.
+func (c *Storage) evict(exclude string) bool {
+	if c.config.EvictionPolicy == EvictNone {
+		return false
+	}
+	victim := ""
+	var victimTime time.Time
+	for key, entry := range c.items {
+		if key == exclude {
+			continue
+		}
+		t := entry.Created
+		if c.config.EvictionPolicy == EvictLRU {
+			t = entry.Latest().ReceivedAt
+		}
+		if victim == "" || t.Before(victimTime) {
+			victim = key
+			victimTime = t
+		}
+	}
+	if victim == "" {
+		return false
+	}
+	c.remove(victim, nil)
+	c.evictions++
+	logger.Println("Storage evicted", victim)
+	return true
+}
+
+func (c *Storage) BuildDebugInfo() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	info := "Storage Debug Info:\n"
+	info += fmt.Sprintf("Entries: %d / %d\n", len(c.items), c.config.MaxEntries)
+	info += fmt.Sprintf("Bytes: %d / %d\n", c.totalBytes, c.config.MaxTotalBytes)
+	info += fmt.Sprintf("Eviction policy: %s, prefer known: %v\n", c.config.EvictionPolicy, c.config.PreferKnown)
+	info += fmt.Sprintf("Evictions: %d\n", c.evictions)
+	info += fmt.Sprintf("Refusals: %d\n", c.refusals)
+	return info
+}
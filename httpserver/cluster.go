@@ -0,0 +1,359 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/topology"
+)
+
+// proxiedHeader marks requests forwarded by another node, so a wrong
+// shard map can not make nodes proxy a request to each other forever.
+const proxiedHeader = "X-U00-Proxied"
+
+// forwardedIP returns the address of the client of a proxied request,
+// which the forwarding node appends to X-Forwarded-For. Earlier entries
+// come from the client and are not trusted.
+func forwardedIP(r *http.Request) string {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return ""
+	}
+	ips := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(ips[len(ips)-1])
+}
+
+// Cluster knows which addresses the node keeps. With the shard placement
+// it follows the shards of the config; with the ring placement it follows
+// the ring membership, which can change at runtime and is saved in
+// ring.json of the data directory.
+type Cluster struct {
+	mtx    sync.Mutex
+	config Config
+	ring   *topology.Ring
+	epoch  int64
+	path   string
+
+	rebalances int64
+	moved      int64
+	dropped    int64
+	lastError  string
+}
+
+// ringState is the content of ring.json.
+type ringState struct {
+	Nodes []string `json:"nodes"`
+	Epoch int64    `json:"epoch"`
+}
+
+func NewCluster(config Config) *Cluster {
+	var c Cluster
+	c.config = config
+	if config.Placement == topology.PlacementRing {
+		c.ring = topology.NewRing(config.RingNodes, config.VirtualNodes, config.ReplicationFactor)
+	}
+	return &c
+}
+
+var cluster = NewCluster(DefaultConfig())
+
+// Load restores the ring membership saved by the last change.
+func (c *Cluster) Load(path string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.path = path
+	if c.ring == nil {
+		return nil
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var state ringState
+	err = json.Unmarshal(bs, &state)
+	if err != nil {
+		return err
+	}
+	c.ring = topology.NewRing(state.Nodes, c.config.VirtualNodes, c.config.ReplicationFactor)
+	c.epoch = state.Epoch
+	return nil
+}
+
+func (c *Cluster) save() error {
+	bs, err := json.Marshal(ringState{Nodes: c.ring.Nodes(), Epoch: c.epoch})
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	err = os.WriteFile(tmpPath, bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+func (c *Cluster) Self() string {
+	return c.config.NodeUrl
+}
+
+// SetRing replaces the ring membership if epoch is newer than the current
+// one and returns the previous ring, or nil if the update is outdated.
+func (c *Cluster) SetRing(nodes []string, epoch int64) (*topology.Ring, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.ring == nil {
+		return nil, errors.New("cluster does not use the ring placement")
+	}
+	if epoch <= c.epoch {
+		return nil, nil
+	}
+	old := c.ring
+	c.ring = topology.NewRing(nodes, c.config.VirtualNodes, c.config.ReplicationFactor)
+	c.epoch = epoch
+	return old, c.save()
+}
+
+func (c *Cluster) currentRing() *topology.Ring {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ring
+}
+
+// Owners returns the nodes keeping the address with the ring placement,
+// the primary first. It is nil with the shard placement.
+func (c *Cluster) Owners(address string) []string {
+	ring := c.currentRing()
+	if ring == nil {
+		return nil
+	}
+	bs, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	if err != nil || len(bs) != frame.AddressSize {
+		return []string{}
+	}
+	return ring.Owners(bs)
+}
+
+// Owns reports whether the node stores the address, as the primary or as
+// a replica. A node without configured shards owns everything.
+func (c *Cluster) Owns(address string) bool {
+	if owners := c.Owners(address); owners != nil {
+		return slices.Contains(owners, c.Self())
+	}
+	if len(c.config.Shards) == 0 {
+		return true
+	}
+	shard := topology.ShardOfHex(address)
+	return slices.Contains(c.config.Shards, shard) || slices.Contains(c.config.ReplicaShards, shard)
+}
+
+// foreignAddress returns the first of the addresses the node does not
+// own, or "" if it owns them all.
+func (c *Cluster) foreignAddress(addresses []string) string {
+	for _, address := range addresses {
+		if !c.Owns(address) {
+			return address
+		}
+	}
+	return ""
+}
+
+// IsPrimary reports whether the node is the primary of the address.
+func (c *Cluster) IsPrimary(address string) bool {
+	if owners := c.Owners(address); owners != nil {
+		return len(owners) > 0 && owners[0] == c.Self()
+	}
+	return len(c.config.Shards) == 0 || slices.Contains(c.config.Shards, topology.ShardOfHex(address))
+}
+
+// OwnsRange reports whether any address starting with the hex prefix
+// may belong to the node.
+func (c *Cluster) OwnsRange(prefix string) bool {
+	if c.currentRing() != nil {
+		return true
+	}
+	return c.Owns(prefix)
+}
+
+// PrimaryUrl returns the url of the primary node of the address.
+func (c *Cluster) PrimaryUrl(address string) string {
+	if owners := c.Owners(address); owners != nil {
+		if len(owners) == 0 {
+			return ""
+		}
+		return owners[0]
+	}
+	shard := topology.ShardOfHex(address)
+	if shard == "" {
+		return ""
+	}
+	return c.shardNodeUrl(shard)
+}
+
+func (c *Cluster) shardNodeUrl(shard string) string {
+	if c.config.NodeUrl != "" && c.IsPrimary(shard) {
+		return c.config.NodeUrl
+	}
+	if nodeUrl, ok := c.config.ShardNodes[shard]; ok {
+		return nodeUrl
+	}
+	return topology.DefaultNodeUrl(shard)
+}
+
+// Peers returns the nodes this node exchanges data with: all other nodes
+// of the ring or the configured peers.
+func (c *Cluster) Peers() []string {
+	ring := c.currentRing()
+	if ring == nil {
+		return c.config.Peers
+	}
+	peers := make([]string, 0)
+	for _, nodeUrl := range ring.Nodes() {
+		if nodeUrl != c.Self() {
+			peers = append(peers, nodeUrl)
+		}
+	}
+	return peers
+}
+
+// PeerHosts returns the resolved IPs of the peers and of the nodes of the
+// other shards, which forward requests with proxy_foreign.
+func (c *Cluster) PeerHosts() map[string]bool {
+	result := make(map[string]bool)
+	peerUrls := slices.Clone(c.Peers())
+	for _, nodeUrl := range c.config.ShardNodes {
+		if nodeUrl != c.Self() {
+			peerUrls = append(peerUrls, nodeUrl)
+		}
+	}
+	for _, peerUrl := range peerUrls {
+		u, err := url.Parse(peerUrl)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			logger.Println("Cluster can not resolve peer", peerUrl, err)
+			continue
+		}
+		for _, ip := range ips {
+			result[ip] = true
+		}
+	}
+	return result
+}
+
+// Topology describes the cluster as this node sees it. With the shard
+// placement its own shards are at node_url and the other shards at
+// shard_nodes.
+func (c *Cluster) Topology() *topology.Topology {
+	c.mtx.Lock()
+	ring, epoch := c.ring, c.epoch
+	c.mtx.Unlock()
+	if ring != nil {
+		return topology.NewRingTopology(ring, c.config.VirtualNodes, c.config.ReplicationFactor, epoch)
+	}
+	return topology.Build(c.shardNodeUrl)
+}
+
+func (c *Cluster) BuildDebugInfo() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	info := "Cluster Debug Info:\n"
+	if c.ring == nil {
+		info += fmt.Sprintf("  Placement: shards, Shards: %v, Replica shards: %v\n", c.config.Shards, c.config.ReplicaShards)
+		return info
+	}
+	info += fmt.Sprintf("  Placement: ring, Node: %s, Epoch: %d, Nodes: %v\n", c.config.NodeUrl, c.epoch, c.ring.Nodes())
+	info += fmt.Sprintf("  Rebalances: %d, Moved: %d, Dropped: %d", c.rebalances, c.moved, c.dropped)
+	if c.lastError != "" {
+		info += ", Last error: " + c.lastError
+	}
+	info += "\n"
+	return info
+}
+
+// requestAddress returns the address a data request is about, or "" for
+// requests not bound to one address. The body of /set is read and put
+// back. A watch of several addresses is not bound to one node.
+func requestAddress(r *http.Request, parts []string) string {
+	switch parts[0] {
+	case "get", "history", "list":
+		if len(parts) > 1 {
+			return parts[1]
+		}
+	case "watch":
+		if len(parts) > 1 && !strings.Contains(parts[1], ",") {
+			return parts[1]
+		}
+	case "v1":
+		if len(parts) > 2 && parts[1] == "entry" {
+			return parts[2]
+		}
+	case "set":
+		bs, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(bs))
+		if err != nil || len(bs) < frame.AddressSize {
+			return ""
+		}
+		f := frame.Frame{Address: bs[:frame.AddressSize]}
+		return f.AddressHex()
+	}
+	return ""
+}
+
+// serveForeign answers a request for an address the node does not own:
+// with a redirect to the owning node or, with proxy_foreign, by
+// forwarding it there. It returns false if the node owns the address.
+func (c *HttpServer) serveForeign(w http.ResponseWriter, r *http.Request, parts []string) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	address := requestAddress(r, parts)
+	if address == "" || cluster.Owns(address) {
+		return false
+	}
+	nodeUrl := cluster.PrimaryUrl(address)
+	if nodeUrl == "" {
+		return false
+	}
+
+	if !c.config.ProxyForeign || r.Header.Get(proxiedHeader) != "" {
+		// 307 keeps the method and the body of /set.
+		http.Redirect(w, r, nodeUrl+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	target, err := url.Parse(nodeUrl)
+	if err != nil {
+		logger.Println("HttpServer wrong node url", nodeUrl, err)
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("wrong node url " + nodeUrl))
+		return true
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+		req.Header.Set(proxiedHeader, "1")
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,25 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestAddress(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	cases := map[string]string{
+		"get/0xab":        "0xab",
+		"watch/0xab":      "0xab",
+		"watch/0xab,0xcd": "",
+		"v1/entry/0xab":   "0xab",
+		"ws":              "",
+		"state":           "",
+	}
+	for path, expected := range cases {
+		if address := requestAddress(r, strings.Split(path, "/")); address != expected {
+			t.Fatal(path, "address", address, "expected", expected)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ipoluianov/map_u00_io/topology"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+const (
+	EvictLRU    = "lru"
+	EvictOldest = "oldest"
+	EvictNone   = "none"
+)
+
+type Config struct {
+	HttpAddr               string            `json:"http_addr"`
+	HttpsAddr              string            `json:"https_addr"`
+	PlainHttp              bool              `json:"plain_http"`
+	DataDir                string            `json:"data_dir"`
+	FsyncPolicy            string            `json:"fsync_policy"`
+	FsyncIntervalMs        int               `json:"fsync_interval_ms"`
+	SnapshotIntervalSec    int               `json:"snapshot_interval_sec"`
+	MaxClockSkewSec        int               `json:"max_clock_skew_sec"`
+	LegacyClockSkewSec     int               `json:"legacy_clock_skew_sec"`
+	MaxEntries             int               `json:"max_entries"`
+	MaxTotalBytes          int64             `json:"max_total_bytes"`
+	EvictionPolicy         string            `json:"eviction_policy"`
+	PreferKnown            bool              `json:"prefer_known"`
+	TombstoneRetentionSec  int               `json:"tombstone_retention_sec"`
+	DefaultTTLSec          int               `json:"default_ttl_sec"`
+	MaxTTLSec              int               `json:"max_ttl_sec"`
+	ExpiredGraceSec        int               `json:"expired_grace_sec"`
+	MaxWatchersPerIP       int               `json:"max_watchers_per_ip"`
+	WatchHeartbeatSec      int               `json:"watch_heartbeat_sec"`
+	WsMessagesPerSec       int               `json:"ws_messages_per_sec"`
+	WsBurst                int               `json:"ws_burst"`
+	WsPingSec              int               `json:"ws_ping_sec"`
+	NodeUrl                string            `json:"node_url"`
+	Shards                 []string          `json:"shards"`
+	ReplicaShards          []string          `json:"replica_shards"`
+	ShardNodes             map[string]string `json:"shard_nodes"`
+	Placement              string            `json:"placement"`
+	RingNodes              []string          `json:"ring_nodes"`
+	VirtualNodes           int               `json:"virtual_nodes"`
+	ReplicationFactor      int               `json:"replication_factor"`
+	ProxyForeign           bool              `json:"proxy_foreign"`
+	Peers                  []string          `json:"peers"`
+	ReplicationQueueSize   int               `json:"replication_queue_size"`
+	ReplicationRetrySec    int               `json:"replication_retry_sec"`
+	AntiEntropyIntervalSec int               `json:"anti_entropy_interval_sec"`
+}
+
+func DefaultConfig() Config {
+	var c Config
+	c.DataDir = "data"
+	c.FsyncPolicy = FsyncInterval
+	c.FsyncIntervalMs = 1000
+	c.SnapshotIntervalSec = 600
+	c.MaxClockSkewSec = 60
+	c.LegacyClockSkewSec = 14 * 3600
+	c.MaxEntries = 1000
+	c.MaxTotalBytes = 64 * 1024 * 1024
+	c.EvictionPolicy = EvictLRU
+	c.PreferKnown = true
+	c.TombstoneRetentionSec = 7 * 24 * 3600
+	c.DefaultTTLSec = 30 * 24 * 3600
+	c.MaxTTLSec = 90 * 24 * 3600
+	c.ExpiredGraceSec = 24 * 3600
+	c.MaxWatchersPerIP = 4
+	c.WatchHeartbeatSec = 15
+	c.WsMessagesPerSec = 10
+	c.WsBurst = 20
+	c.WsPingSec = 20
+	c.Placement = topology.PlacementShards
+	c.VirtualNodes = 64
+	c.ReplicationFactor = 2
+	c.ReplicationQueueSize = 10000
+	c.ReplicationRetrySec = 1
+	c.AntiEntropyIntervalSec = 60
+	return c
+}
+
+// LoadConfig reads a JSON config file on top of the defaults.
+// A missing file is not an error.
+func LoadConfig(path string) (Config, error) {
+	c := DefaultConfig()
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c, nil
+		}
+		return c, err
+	}
+	err = json.Unmarshal(bs, &c)
+	if err != nil {
+		return c, err
+	}
+	for i, peer := range c.Peers {
+		c.Peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	for _, shard := range append(slices.Clone(c.Shards), c.ReplicaShards...) {
+		if !topology.IsShard(shard) {
+			return c, errors.New("unknown shard: " + shard)
+		}
+	}
+	c.NodeUrl = strings.TrimSuffix(c.NodeUrl, "/")
+	for shard, nodeUrl := range c.ShardNodes {
+		c.ShardNodes[shard] = strings.TrimSuffix(nodeUrl, "/")
+	}
+	for i, nodeUrl := range c.RingNodes {
+		c.RingNodes[i] = strings.TrimSuffix(nodeUrl, "/")
+	}
+	switch c.Placement {
+	case topology.PlacementShards:
+	case topology.PlacementRing:
+		if c.NodeUrl == "" {
+			return c, errors.New("ring placement requires node_url")
+		}
+		if !slices.Contains(c.RingNodes, c.NodeUrl) {
+			c.RingNodes = append(c.RingNodes, c.NodeUrl)
+		}
+	default:
+		return c, errors.New("unknown placement: " + c.Placement)
+	}
+	switch c.FsyncPolicy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return c, errors.New("unknown fsync_policy: " + c.FsyncPolicy)
+	}
+	if c.FsyncPolicy == FsyncInterval {
+		err = checkPositive(configValue{"fsync_interval_ms", c.FsyncIntervalMs})
+		if err != nil {
+			return c, err
+		}
+	}
+	switch c.EvictionPolicy {
+	case EvictLRU, EvictOldest, EvictNone:
+	default:
+		return c, errors.New("unknown eviction_policy: " + c.EvictionPolicy)
+	}
+	err = checkPositive(
+		configValue{"ws_ping_sec", c.WsPingSec},
+		configValue{"ws_messages_per_sec", c.WsMessagesPerSec},
+		configValue{"ws_burst", c.WsBurst},
+		configValue{"watch_heartbeat_sec", c.WatchHeartbeatSec},
+		configValue{"replication_queue_size", c.ReplicationQueueSize},
+		configValue{"replication_retry_sec", c.ReplicationRetrySec},
+	)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+type configValue struct {
+	name  string
+	value int
+}
+
+// checkPositive rejects intervals and limits that would stop timers from
+// being created or disable a feature by accident.
+func checkPositive(values ...configValue) error {
+	for _, v := range values {
+		if v.value <= 0 {
+			return errors.New(v.name + " must be positive")
+		}
+	}
+	return nil
+}
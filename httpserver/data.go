@@ -1,31 +1,128 @@
 package httpserver
 
 import (
-	"crypto/ed25519"
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/receipt"
 )
 
 type Item struct {
-	Address   []byte `json:"address"`
-	Data      []byte `json:"data"`
-	Signature []byte `json:"signature"`
+	Address    []byte    `json:"address"`
+	Data       []byte    `json:"data"`
+	Signature  []byte    `json:"signature"`
+	Name       string    `json:"name"`
+	Time       time.Time `json:"time"`
+	Seq        uint64    `json:"seq,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Version    uint64    `json:"version"`
+	ReceivedAt time.Time `json:"received_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	Receipt *receipt.Receipt `json:"receipt,omitempty"`
+}
+
+// Entry keeps the last MaxHistorySize items of an (address, name) pair,
+// newest first.
+type Entry struct {
+	Address string
+	Name    string
+	History []*Item
+	Created time.Time
+	Size    int64
 }
 
 type Storage struct {
-	mtx   sync.Mutex
-	items map[string]*Item
+	mtx          sync.Mutex
+	items        map[string]*Entry
+	config       Config
+	totalBytes   int64
+	evictions    int64
+	refusals     int64
+	expired      map[string]*expiredRecord
+	wal          *WAL
+	walPath      string
+	snapshotPath string
+	stop         chan struct{}
+}
+
+// walRecord is a logged change: "set" stores Item, "drop" removes the
+// entry Key and, if Expired is set, remembers it as expired.
+type walRecord struct {
+	Op      string         `json:"op"`
+	Item    *Item          `json:"item,omitempty"`
+	Key     string         `json:"key,omitempty"`
+	Expired *expiredRecord `json:"expired,omitempty"`
 }
 
 const (
-	MaxDataSize    = 10 * 1024
+	MaxDataSize    = frame.MaxDataSize
 	MaxHistorySize = 10
 )
 
+// NewerThan orders items by the signed timestamp and then by the
+// sequence number of v2 frames.
+func (c *Item) NewerThan(other *Item) bool {
+	if !c.Time.Equal(other.Time) {
+		return c.Time.After(other.Time)
+	}
+	return c.Seq > other.Seq
+}
+
+func (c *Item) Expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+// Live reports whether the item is neither a tombstone nor expired.
+func (c *Item) Live(now time.Time) bool {
+	return !c.Deleted && !c.Expired(now)
+}
+
+func (c *Entry) Latest() *Item {
+	if len(c.History) == 0 {
+		return nil
+	}
+	return c.History[0]
+}
+
+// At returns the item that was current at the moment t.
+func (c *Entry) At(t time.Time) *Item {
+	for _, item := range c.History {
+		if !item.ReceivedAt.After(t) {
+			return item
+		}
+	}
+	return nil
+}
+
+// push adds the item and returns the change of the entry size.
+func (c *Entry) push(item *Item) int64 {
+	delta := itemSize(item)
+	c.History = slices.Insert(c.History, 0, item)
+	if len(c.History) > MaxHistorySize {
+		for _, dropped := range c.History[MaxHistorySize:] {
+			delta -= itemSize(dropped)
+		}
+		c.History = c.History[:MaxHistorySize]
+	}
+	c.Size += delta
+	return delta
+}
+
 func NewStorage() *Storage {
 	var c Storage
-	c.items = make(map[string]*Item)
+	c.items = make(map[string]*Entry)
+	c.expired = make(map[string]*expiredRecord)
+	c.config = DefaultConfig()
 	return &c
 }
 
@@ -35,42 +132,472 @@ func init() {
 	storage = NewStorage()
 }
 
-func GetData(code string) []byte {
+// dataDirPath resolves data_dir relative to the executable.
+func dataDirPath(config Config) string {
+	if filepath.IsAbs(config.DataDir) {
+		return config.DataDir
+	}
+	return logger.CurrentExePath() + "/" + config.DataDir
+}
+
+// Open restores the state from the last snapshot and the write-ahead log
+// and starts logging new writes.
+func (c *Storage) Open(config Config) error {
+	c.config = config
+	dir := dataDirPath(config)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	c.walPath = dir + "/wal.dat"
+	c.snapshotPath = dir + "/snapshot.dat"
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	count := 0
+	replay := func(payload []byte) {
+		var rec walRecord
+		err := json.Unmarshal(payload, &rec)
+		if err == nil && rec.Op == "drop" {
+			c.remove(rec.Key, rec.Expired)
+			return
+		}
+		if err != nil || rec.Item == nil {
+			logger.Println("Storage::Open bad record:", err)
+			return
+		}
+		if !cluster.Owns("0x" + hex.EncodeToString(rec.Item.Address)) {
+			return
+		}
+		err = c.apply(rec.Item)
+		if err != nil {
+			logger.Println("Storage::Open record skipped:", err)
+			return
+		}
+		count++
+	}
+
+	validSize, err := ReadRecords(c.snapshotPath, replay)
+	if errors.Is(err, ErrCorruptRecords) {
+		err = setAside(c.snapshotPath, validSize)
+	}
+	if err != nil {
+		return err
+	}
+	validSize, err = ReadRecords(c.walPath, replay)
+	if errors.Is(err, ErrCorruptRecords) {
+		err = setAside(c.walPath, validSize)
+	}
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(c.walPath)
+	if err == nil && st.Size() > validSize {
+		logger.Println("Storage::Open truncating wal from", st.Size(), "to", validSize)
+		err = os.Truncate(c.walPath, validSize)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Println("Storage::Open replayed", count, "records,", len(c.items), "entries")
+
+	c.wal, err = OpenWAL(c.walPath, config.FsyncPolicy, time.Duration(config.FsyncIntervalMs)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	c.stop = make(chan struct{})
+	if config.SnapshotIntervalSec > 0 {
+		go c.thSnapshot(time.Duration(config.SnapshotIntervalSec) * time.Second)
+	}
+	go c.thSweep()
+	return nil
+}
+
+func (c *Storage) Close() error {
+	err := c.Snapshot()
+	if err != nil {
+		logger.Println("Storage::Close snapshot error:", err)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.wal == nil {
+		return nil
+	}
+	close(c.stop)
+	err = c.wal.Close()
+	c.wal = nil
+	return err
+}
+
+func (c *Storage) thSnapshot(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			err := c.Snapshot()
+			if err != nil {
+				logger.Println("Storage snapshot error:", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes the compacted state and empties the write-ahead log.
+func (c *Storage) Snapshot() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.wal == nil || c.wal.Size() == 0 {
+		return nil
+	}
+
+	// Swept entries go first: an entry written again after it expired is
+	// then restored by its later records.
+	expiredKeys := make([]string, 0, len(c.expired))
+	for key := range c.expired {
+		expiredKeys = append(expiredKeys, key)
+	}
+	slices.Sort(expiredKeys)
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	payloads := make([][]byte, 0, len(expiredKeys)+len(keys))
+	for _, key := range expiredKeys {
+		payload, err := json.Marshal(walRecord{Op: "drop", Key: key, Expired: c.expired[key]})
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
+	}
+	for _, key := range keys {
+		history := c.items[key].History
+		for i := len(history) - 1; i >= 0; i-- {
+			payload, err := json.Marshal(walRecord{Op: "set", Item: history[i]})
+			if err != nil {
+				return err
+			}
+			payloads = append(payloads, payload)
+		}
+	}
+
+	err := WriteSnapshot(c.snapshotPath, payloads)
+	if err != nil {
+		return err
+	}
+	logger.Println("Storage snapshot written:", len(payloads), "records")
+	return c.wal.Reset()
+}
+
+func entryKey(address string, name string) string {
+	return address + "/" + name
+}
+
+func itemKey(item *Item) string {
+	return entryKey("0x"+hex.EncodeToString(item.Address), item.Name)
+}
+
+func (c *Storage) apply(item *Item) error {
+	key := itemKey(item)
+	err := c.admit(key, item)
+	if err != nil {
+		return err
+	}
+	c.store(key, item)
+	return nil
+}
+
+func (c *Storage) store(key string, item *Item) {
+	entry, exists := c.items[key]
+	if !exists {
+		entry = &Entry{
+			Address: "0x" + hex.EncodeToString(item.Address),
+			Name:    item.Name,
+			Created: item.ReceivedAt,
+		}
+		c.items[key] = entry
+	}
+	c.totalBytes += entry.push(item)
+}
+
+// findEntry returns the entry of the address with the given name.
+// An empty name selects the most recently written entry of the address.
+func (c *Storage) findEntry(address string, name string) *Entry {
+	if name != "" {
+		return c.items[entryKey(address, name)]
+	}
+	var result *Entry
+	now := time.Now()
+	for _, entry := range c.items {
+		if entry.Address != address || !entry.Latest().Live(now) {
+			continue
+		}
+		if result == nil || entry.Latest().ReceivedAt.After(result.Latest().ReceivedAt) {
+			result = entry
+		}
+	}
+	return result
+}
+
+// dropEntries forgets the entries, e.g. after they were handed over to
+// their new owners.
+func (c *Storage) dropEntries(keys []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, key := range keys {
+		if _, exists := c.items[key]; exists {
+			c.remove(key, nil)
+		}
+	}
+}
+
+// remove forgets the entry and logs it, so the entry does not come back
+// on replay. Must be called under c.mtx.
+func (c *Storage) remove(key string, expired *expiredRecord) {
+	if entry, exists := c.items[key]; exists {
+		c.totalBytes -= entry.Size
+		delete(c.items, key)
+	}
+	if expired != nil {
+		c.expired[key] = expired
+	}
+	if c.wal == nil {
+		return
+	}
+	payload, err := json.Marshal(walRecord{Op: "drop", Key: key, Expired: expired})
+	if err == nil {
+		err = c.wal.Append(payload)
+	}
+	if err != nil {
+		logger.Println("Storage remove", key, "wal error:", err)
+	}
+}
+
+func (c *Storage) logItem(item *Item) error {
+	if c.wal == nil {
+		return nil
+	}
+	payload, err := json.Marshal(walRecord{Op: "set", Item: item})
+	if err != nil {
+		return err
+	}
+	return c.wal.Append(payload)
+}
+
+// GetItem returns the latest item stored under the name. An empty name
+// selects the most recently written item of the address. Missing and
+// deleted entries give nil; recently expired ones give ErrExpired.
+func GetItem(address string, name string) (*Item, error) {
+	item, err := GetLatestItem(address, name)
+	if item != nil && item.Deleted {
+		return nil, nil
+	}
+	return item, err
+}
+
+// GetLatestItem is GetItem that also returns tombstones, so a client can
+// order a deletion against the values held by other nodes.
+func GetLatestItem(address string, name string) (*Item, error) {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	now := time.Now()
+	entry := storage.findEntry(address, name)
+	if entry == nil {
+		if storage.recentlyExpired(address, name) {
+			return nil, ErrExpired
+		}
+		return nil, nil
+	}
+	item := entry.Latest()
+	if !item.Deleted && item.Expired(now) {
+		return nil, ErrExpired
+	}
+	return item, nil
+}
+
+func GetItemAt(address string, name string, t time.Time) *Item {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	var result *Item
+	for _, entry := range storage.items {
+		if entry.Address != address || (name != "" && entry.Name != name) {
+			continue
+		}
+		item := entry.At(t)
+		if item != nil && (result == nil || item.ReceivedAt.After(result.ReceivedAt)) {
+			result = item
+		}
+	}
+	if result != nil && result.Deleted {
+		return nil
+	}
+	return result
+}
+
+// GetHistory returns the stored items of the entry, newest first.
+func GetHistory(address string, name string) []*Item {
 	storage.mtx.Lock()
-	if item, ok := storage.items[code]; ok {
-		bs := item.Data
-		storage.mtx.Unlock()
-		return bs
+	defer storage.mtx.Unlock()
+	if entry := storage.findEntry(address, name); entry != nil {
+		return slices.Clone(entry.History)
 	}
-	storage.mtx.Unlock()
 	return nil
 }
 
-func SetData(bs []byte) error {
-	if len(bs) < 32+64 {
-		return errors.New("data too short")
+// GetAddressItems returns the latest live items of every name of the
+// address.
+func GetAddressItems(address string) []*Item {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	now := time.Now()
+	items := make([]*Item, 0)
+	for _, entry := range storage.items {
+		if entry.Address == address && entry.Latest().Live(now) {
+			items = append(items, entry.Latest())
+		}
 	}
+	return items
+}
 
-	address := bs[:32]
-	signature := bs[32:96]
-	value := bs[96:]
+// GetNames returns the sorted names stored for the address.
+func GetNames(address string) []string {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	names := make([]string, 0)
+	now := time.Now()
+	for _, entry := range storage.items {
+		if entry.Address == address && entry.Latest().Live(now) {
+			names = append(names, entry.Name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
 
-	verifyResult := ed25519.Verify(address, value, signature)
-	if !verifyResult {
-		return errors.New("invalid signature")
+// GetAddresses lists the live addresses of the shards the node is the
+// primary for.
+func GetAddresses() []string {
+	storage.mtx.Lock()
+	defer storage.mtx.Unlock()
+	addresses := make([]string, 0)
+	now := time.Now()
+	for _, entry := range storage.items {
+		if entry.Latest().Live(now) && cluster.IsPrimary(entry.Address) {
+			addresses = append(addresses, entry.Address)
+		}
+	}
+	slices.Sort(addresses)
+	return slices.Compact(addresses)
+}
+
+type SetResult struct {
+	Version  uint64           `json:"version"`
+	LogIndex uint64           `json:"log_index"`
+	LeafHash []byte           `json:"leaf_hash"`
+	Receipt  *receipt.Receipt `json:"receipt,omitempty"`
+}
+
+func (c *Storage) currentVersion(key string) uint64 {
+	if entry, exists := c.items[key]; exists {
+		return entry.Latest().Version
+	}
+	return 0
+}
+
+// resent returns the result of the stored write if the item repeats the
+// latest frame of the entry, e.g. when a client writes to a replica that
+// already got the frame from the primary. Must be called under c.mtx.
+func (c *Storage) resent(key string, item *Item, frameBS []byte) *SetResult {
+	entry, exists := c.items[key]
+	if !exists {
+		return nil
+	}
+	latest := entry.Latest()
+	if latest == nil || !bytes.Equal(latest.Signature, item.Signature) || !bytes.Equal(latest.Data, item.Data) {
+		return nil
+	}
+	result := SetResult{Version: latest.Version, Receipt: latest.Receipt}
+	result.LogIndex, result.LeafHash, _ = translog.Lookup(frameBS)
+	return &result
+}
+
+func SetData(bs []byte) (*SetResult, error) {
+	return setData(bs, false)
+}
+
+// setData stores a signed frame. Frames forwarded by peers skip the
+// compare-and-swap check, since versions are local to each node, and are
+// not forwarded again.
+func setData(bs []byte, replicated bool) (*SetResult, error) {
+	f, err := frame.Verify(bs)
+	if err != nil {
+		return nil, frameError(err)
+	}
+
+	if !cluster.Owns(f.AddressHex()) {
+		return nil, ErrWrongShard
+	}
+
+	now := time.Now().UTC()
+	maxSkew := time.Duration(storage.config.MaxClockSkewSec) * time.Second
+	if f.LegacyTime {
+		// Zone-less v1 times of older clients may be local times.
+		maxSkew = max(maxSkew, time.Duration(storage.config.LegacyClockSkewSec)*time.Second)
+	}
+	if f.Time.After(now.Add(maxSkew)) {
+		return nil, ErrFutureFrame
 	}
 
 	item := Item{
-		Address:   address,
-		Data:      value,
-		Signature: signature,
+		Address:    f.Address,
+		Data:       f.Payload,
+		Signature:  f.Signature,
+		Name:       f.Name,
+		Time:       f.Time,
+		Seq:        f.Seq,
+		Deleted:    f.Delete,
+		ReceivedAt: now,
+	}
+	if nodeKey != nil {
+		item.Receipt = receipt.New(nodeKey, f.Bytes(), f.Address, now)
 	}
 
-	addressHex := "0x" + hex.EncodeToString(address)
 	storage.mtx.Lock()
-	if len(storage.items) < 1000 {
-		storage.items[addressHex] = &item
+	defer storage.mtx.Unlock()
+	item.ExpiresAt = storage.expiryTime(f.TTL, now)
+	key := itemKey(&item)
+	if !replicated {
+		if result := storage.resent(key, &item, f.Bytes()); result != nil {
+			return result, nil
+		}
 	}
-	storage.mtx.Unlock()
-	return nil
+	version := storage.currentVersion(key)
+	if f.HasExpectedVersion && !replicated && f.ExpectedVersion != version {
+		return nil, ErrConflict
+	}
+	item.Version = version + 1
+	err = storage.admit(key, &item)
+	if err != nil {
+		return nil, err
+	}
+	err = storage.logItem(&item)
+	if err != nil {
+		logger.Println("SetData wal error:", err)
+		return nil, errors.New("storage error")
+	}
+	storage.store(key, &item)
+	result := SetResult{Version: item.Version, Receipt: item.Receipt}
+	result.LogIndex, result.LeafHash, err = translog.Append(f.Bytes())
+	if err != nil {
+		logger.Println("SetData transparency log error:", err)
+	}
+	hub.Publish(&item)
+	if !replicated {
+		replicator.Enqueue(bs)
+	}
+	return &result, nil
 }
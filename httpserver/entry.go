@@ -0,0 +1,127 @@
+package httpserver
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/receipt"
+)
+
+const (
+	FormatRaw    = "raw"
+	FormatHex    = "hex"
+	FormatBase64 = "base64"
+	FormatJSON   = "json"
+	FormatValue  = "value"
+)
+
+// EntryView is the decoded, verified form of a stored item.
+type EntryView struct {
+	Address    string    `json:"address"`
+	Name       string    `json:"name"`
+	Value      string    `json:"value"`
+	Encoding   string    `json:"encoding"`
+	Time       time.Time `json:"time"`
+	ReceivedAt time.Time `json:"received_at"`
+	Version    uint64    `json:"version"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Signature  string    `json:"signature"`
+	Verified   bool      `json:"verified"`
+	Frame      []byte    `json:"frame"`
+
+	Receipt *receipt.Receipt `json:"receipt,omitempty"`
+}
+
+func isTextValue(f *frame.Frame) bool {
+	if f.Version == frame.Version2 && (f.ContentType == frame.ContentTypeBinary || f.ContentType == frame.ContentTypeEncrypted) {
+		return false
+	}
+	return utf8.Valid(f.Value)
+}
+
+func NewEntryView(item *Item) *EntryView {
+	var c EntryView
+	c.Address = "0x" + hex.EncodeToString(item.Address)
+	c.Name = item.Name
+	c.Time = item.Time
+	c.ReceivedAt = item.ReceivedAt
+	c.Version = item.Version
+	c.Deleted = item.Deleted
+	c.Receipt = item.Receipt
+	c.Signature = "0x" + hex.EncodeToString(item.Signature)
+	c.Verified = len(item.Address) == ed25519.PublicKeySize && ed25519.Verify(item.Address, item.Data, item.Signature)
+
+	f := frame.Frame{Address: item.Address, Signature: item.Signature, Payload: item.Data}
+	c.Frame = f.Bytes()
+
+	decoded, err := frame.DecodePayload(item.Data)
+	if err != nil {
+		c.Verified = false
+		return &c
+	}
+	if isTextValue(decoded) {
+		c.Value = string(decoded.Value)
+		c.Encoding = "text"
+	} else {
+		c.Value = base64.StdEncoding.EncodeToString(decoded.Value)
+		c.Encoding = "base64"
+	}
+	return &c
+}
+
+// writeItem writes the stored payload of the item in the requested format.
+func writeItem(w http.ResponseWriter, item *Item, format string) {
+	switch format {
+	case "", FormatRaw:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if item != nil {
+			w.Write(item.Data)
+		}
+	case FormatHex:
+		w.Header().Set("Content-Type", "text/plain")
+		if item != nil {
+			w.Write([]byte(hex.EncodeToString(item.Data)))
+		}
+	case FormatBase64:
+		w.Header().Set("Content-Type", "text/plain")
+		if item != nil {
+			w.Write([]byte(base64.StdEncoding.EncodeToString(item.Data)))
+		}
+	case FormatJSON:
+		if item == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("Not Found"))
+			return
+		}
+		result, _ := json.Marshal(NewEntryView(item))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+	case FormatValue:
+		if item == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("Not Found"))
+			return
+		}
+		f, err := frame.DecodePayload(item.Data)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte("wrong request: api - " + err.Error()))
+			return
+		}
+		if isTextValue(f) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.Write(f.Value)
+	default:
+		w.WriteHeader(400)
+		w.Write([]byte("wrong request: api - unknown format " + format))
+	}
+}
@@ -0,0 +1,47 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/ipoluianov/map_u00_io/frame"
+)
+
+// ApiError is a rejection with its own HTTP status and a stable code
+// that clients can match on.
+type ApiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ApiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	ErrStaleFrame   = &ApiError{Status: http.StatusConflict, Code: "stale_frame", Message: "frame is not newer than the stored one"}
+	ErrFutureFrame  = &ApiError{Status: http.StatusUnprocessableEntity, Code: "future_frame", Message: "frame timestamp is too far in the future"}
+	ErrStorageFull  = &ApiError{Status: http.StatusInsufficientStorage, Code: "storage_full", Message: "storage capacity exceeded"}
+	ErrConflict     = &ApiError{Status: http.StatusConflict, Code: "version_conflict", Message: "stored version does not match the expected one"}
+	ErrExpired      = &ApiError{Status: http.StatusGone, Code: "expired", Message: "entry has expired"}
+	ErrLeafNotFound = &ApiError{Status: http.StatusNotFound, Code: "leaf_not_found", Message: "frame is not in the log"}
+	ErrWrongShard   = &ApiError{Status: http.StatusMisdirectedRequest, Code: "wrong_shard", Message: "address belongs to a shard of another node"}
+)
+
+// frameError converts a frame validation failure to an ApiError.
+func frameError(err error) error {
+	var frameErr *frame.Error
+	if errors.As(err, &frameErr) {
+		return &ApiError{Status: http.StatusBadRequest, Code: frameErr.Code, Message: err.Error()}
+	}
+	return err
+}
+
+func errorStatus(err error) int {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	return http.StatusInternalServerError
+}
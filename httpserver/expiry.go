@@ -0,0 +1,85 @@
+package httpserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+// expiredRecord remembers a swept entry for the grace period, so reads can
+// answer 410 Gone and replays of older frames are still rejected.
+type expiredRecord struct {
+	Time      time.Time `json:"time"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
+// expiryTime applies the default and the maximum TTL of the config to the
+// TTL requested by the frame.
+func (c *Storage) expiryTime(ttl time.Duration, now time.Time) time.Time {
+	if ttl <= 0 {
+		ttl = time.Duration(c.config.DefaultTTLSec) * time.Second
+	}
+	maxTTL := time.Duration(c.config.MaxTTLSec) * time.Second
+	if maxTTL > 0 && (ttl <= 0 || ttl > maxTTL) {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (c *Storage) recentlyExpired(address string, name string) bool {
+	if name != "" {
+		_, exists := c.expired[entryKey(address, name)]
+		return exists
+	}
+	prefix := entryKey(address, "")
+	for key := range c.expired {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Storage) thSweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Sweep(time.Now().UTC())
+		}
+	}
+}
+
+// Sweep removes expired entries and tombstones older than the retention
+// period.
+func (c *Storage) Sweep(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	retention := time.Duration(c.config.TombstoneRetentionSec) * time.Second
+	for key, entry := range c.items {
+		latest := entry.Latest()
+		if latest.Deleted && now.Sub(latest.ReceivedAt) > retention {
+			c.remove(key, nil)
+			logger.Println("Storage tombstone expired", key)
+			continue
+		}
+		if !latest.Deleted && latest.Expired(now) {
+			c.remove(key, &expiredRecord{Time: latest.Time, ExpiredAt: latest.ExpiresAt})
+			logger.Println("Storage entry expired", key)
+		}
+	}
+
+	grace := time.Duration(c.config.ExpiredGraceSec) * time.Second
+	for key, rec := range c.expired {
+		if now.Sub(rec.ExpiredAt) > grace {
+			delete(c.expired, key)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package httpserver
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,12 +33,18 @@ type HttpServer struct {
 	srv        *http.Server
 	srvTLS     *http.Server
 	clients    map[string]*Client
+	watchers   map[string]int
 	mtxClients sync.Mutex
+	config     Config
+	peerIPs    map[string]bool
 }
 
 func NewHttpServer() *HttpServer {
 	var c HttpServer
 	c.clients = make(map[string]*Client)
+	c.watchers = make(map[string]int)
+	c.config = DefaultConfig()
+	c.peerIPs = make(map[string]bool)
 	return &c
 }
 
@@ -50,13 +59,83 @@ func NewClient(remoteAddr string) *Client {
 	}
 }
 
-func (c *HttpServer) Start() {
+// Start loads the config from pathToConfig, or from config.json next to
+// the executable if the path is empty, and starts serving. A node with a
+// wrong config or without its storage must not serve, so both errors are
+// returned.
+func (c *HttpServer) Start(pathToConfig string) error {
+	if pathToConfig == "" {
+		pathToConfig = logger.CurrentExePath() + "/config.json"
+	}
+	logger.Println("HttpServer::Start config path:", pathToConfig)
+	config, err := LoadConfig(pathToConfig)
+	if err != nil {
+		logger.Println("HttpServer::Start loading config ERROR", err)
+		return err
+	}
+	c.config = config
+
+	cluster = NewCluster(c.config)
+	err = cluster.Load(dataDirPath(c.config) + "/ring.json")
+	if err != nil {
+		logger.Println("HttpServer::Start loading ring ERROR", err)
+	}
+
+	nodeKey, err = loadNodeKey(logger.CurrentExePath() + "/node.key")
+	if err != nil {
+		logger.Println("HttpServer::Start loading node key ERROR", err)
+	}
+	logger.Println("HttpServer::Start node id:", nodeID())
+
+	err = storage.Open(c.config)
+	if err != nil {
+		logger.Println("HttpServer::Start opening storage ERROR", err)
+		return err
+	}
+	err = translog.Open(dataDirPath(c.config)+"/merkle.dat", c.config.FsyncPolicy)
+	if err != nil {
+		logger.Println("HttpServer::Start opening transparency log ERROR", err)
+	}
+
+	replicator = NewReplicator(c.config)
+	c.updatePeerIPs()
+	replicator.Start()
+	antiEntropy = NewAntiEntropy(c.config)
+	antiEntropy.Start()
+
 	go c.thListen()
 	go c.thListenTLS()
 	go c.thTest()
 	//go c.thTest()
 	//go c.thTestRandom()
 	go c.cleanupClients()
+	return nil
+}
+
+func (c *HttpServer) Stop() {
+	err := storage.Close()
+	if err != nil {
+		logger.Println("HttpServer::Stop closing storage ERROR", err)
+	}
+	err = translog.Close()
+	if err != nil {
+		logger.Println("HttpServer::Stop closing transparency log ERROR", err)
+	}
+}
+
+// updatePeerIPs resolves the current peers, which are exempt from the
+// rate limit of the node-to-node API.
+func (c *HttpServer) updatePeerIPs() {
+	peerIPs := cluster.PeerHosts()
+	c.mtxClients.Lock()
+	c.peerIPs = peerIPs
+	c.mtxClients.Unlock()
+}
+
+func (c *HttpServer) isPeer(ip string) bool {
+	c.mtxClients.Lock()
+	defer c.mtxClients.Unlock()
+	return c.peerIPs[ip]
 }
 
 func (c *Client) Allow() bool {
@@ -96,6 +175,8 @@ func (c *HttpServer) BuildDebugInfo() string {
 	c.mtxClients.Lock()
 	info := "HttpServer Debug Info:\n"
 	info += "Number of clients: " + fmt.Sprint((len(c.clients))) + "\n"
+	info += "Number of watchers: " + fmt.Sprint(c.watcherCount()) + "\n"
+	info += "Node id: " + nodeID() + ", Log size: " + fmt.Sprint(translog.Size()) + "\n"
 	info += "Clients:\n"
 	ips := make([]string, 0)
 	for ip := range c.clients {
@@ -107,6 +188,10 @@ func (c *HttpServer) BuildDebugInfo() string {
 		info += fmt.Sprintf("  IP: %s, Last Seen: %s\n", ip, client.LastSeen.UTC().Format("2006-01-02 15:04:05.000"))
 	}
 	c.mtxClients.Unlock()
+	info += storage.BuildDebugInfo()
+	info += cluster.BuildDebugInfo()
+	info += replicator.BuildDebugInfo()
+	info += antiEntropy.BuildDebugInfo()
 	return info
 }
 
@@ -164,6 +249,9 @@ func (c *HttpServer) thTestRandom() {
 }*/
 
 func (c *HttpServer) portHttp() string {
+	if c.config.HttpAddr != "" {
+		return c.config.HttpAddr
+	}
 	if utils.IsRoot() {
 		return ":80"
 	}
@@ -171,6 +259,9 @@ func (c *HttpServer) portHttp() string {
 }
 
 func (c *HttpServer) portHttps() string {
+	if c.config.HttpsAddr != "" {
+		return c.config.HttpsAddr
+	}
 	if utils.IsRoot() {
 		return ":443"
 	}
@@ -241,10 +332,50 @@ func (c *HttpServer) thListenTLS() {
 	logger.Println("HttpServer::thListenTLS end")
 }
 
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// watcherCount must be called under c.mtxClients.
+func (c *HttpServer) watcherCount() int {
+	count := 0
+	for _, n := range c.watchers {
+		count += n
+	}
+	return count
+}
+
+// parseTimestamp accepts RFC 3339, "2006-01-02 15:04:05.000" (UTC)
+// or unix time in milliseconds.
+func parseTimestamp(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05.000", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("wrong timestamp: " + value)
+}
+
 func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+	ip := clientIP(r)
+	isPeer := c.isPeer(ip)
+	isPeerRequest := strings.HasPrefix(r.URL.Path, "/peer/")
+	// Only peers may send the large batches of the node-to-node API.
+	if isPeerRequest && isPeer {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPeerBodySize)
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+	}
 
-	if r.TLS == nil {
+	if r.TLS == nil && !c.config.PlainHttp {
 		logger.Println("ProcessHTTP host: ", r.Host)
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		if r.Method == "OPTIONS" {
@@ -275,12 +406,15 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	////////////////////////////////////////
 	// Rate limiting
-	{
-		ip := r.RemoteAddr
-		parts := strings.Split(ip, ":")
-		if len(parts) > 0 {
-			ip = parts[0]
+	// Requests proxied by a peer are limited by the address of their
+	// client, not by the one of the peer.
+	if isPeer && r.Header.Get(proxiedHeader) != "" {
+		if forwarded := forwardedIP(r); forwarded != "" {
+			ip = forwarded
+			isPeer = false
 		}
+	}
+	if !isPeerRequest || !isPeer {
 		cl := c.getClient(ip)
 		cl.LastSeen = time.Now()
 		if !cl.Allow() {
@@ -293,7 +427,7 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	////////////////////////////////////////
 
-	parts := strings.FieldsFunc(r.RequestURI, func(r rune) bool {
+	parts := strings.FieldsFunc(r.URL.Path, func(r rune) bool {
 		return r == '/'
 	})
 
@@ -305,19 +439,106 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		reqType = parts[0]
 	}
 
+	if c.serveForeign(w, r, parts) {
+		return
+	}
+
 	if reqType == "get" {
 		if len(parts) < 2 {
 			w.WriteHeader(500)
 			w.Write([]byte("wrong request: api - missing argument"))
 			return
 		}
-		pageCode := parts[1]
-		result := GetData(pageCode)
-		w.Header().Set("Content-Type", "application/octet-stream")
+		address := parts[1]
+		name := strings.Join(parts[2:], "/")
+		var item *Item
+		var err error
+		if at := r.URL.Query().Get("at"); at != "" {
+			t, err := parseTimestamp(at)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("wrong request: api - " + err.Error()))
+				return
+			}
+			item = GetItemAt(address, name, t)
+		} else {
+			item, err = GetItem(address, name)
+		}
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			w.Write([]byte("wrong request: api - " + err.Error()))
+			return
+		}
+		writeItem(w, item, r.URL.Query().Get("format"))
+		return
+	}
+
+	if reqType == "v1" && len(parts) > 1 && parts[1] == "entry" {
+		if len(parts) < 3 {
+			w.WriteHeader(500)
+			w.Write([]byte("wrong request: api - missing argument"))
+			return
+		}
+		item, err := GetLatestItem(parts[2], strings.Join(parts[3:], "/"))
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			w.Write([]byte("wrong request: api - " + err.Error()))
+			return
+		}
+		writeItem(w, item, FormatJSON)
+		return
+	}
+
+	if reqType == "v1" && len(parts) > 1 && parts[1] == "topology" {
+		result, _ = json.Marshal(cluster.Topology())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return
+	}
+
+	if reqType == "v1" && len(parts) > 1 && parts[1] == "log" {
+		c.serveLog(w, r, parts)
+		return
+	}
+
+	if reqType == "history" {
+		if len(parts) < 2 {
+			w.WriteHeader(500)
+			w.Write([]byte("wrong request: api - missing argument"))
+			return
+		}
+		history := GetHistory(parts[1], strings.Join(parts[2:], "/"))
+		if history == nil {
+			history = make([]*Item, 0)
+		}
+		result, _ = json.Marshal(history)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return
+	}
+
+	if reqType == "list" {
+		if len(parts) < 2 {
+			w.WriteHeader(500)
+			w.Write([]byte("wrong request: api - missing argument"))
+			return
+		}
+		result, _ = json.Marshal(GetNames(parts[1]))
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(result)
 		return
 	}
 
+	if reqType == "ws" {
+		c.serveWebSocket(w, r)
+		return
+	}
+
+	if reqType == "watch" {
+		c.serveWatch(w, r, parts)
+		return
+	}
+
 	if reqType == "set" {
 		bs, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -326,23 +547,25 @@ func (c *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = SetData(bs)
+		setResult, err := SetData(bs)
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(errorStatus(err))
 			w.Write([]byte("wrong request: api - " + err.Error()))
 			return
 		}
-		w.WriteHeader(200)
+		result, _ = json.Marshal(setResult)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+		return
+	}
+
+	if reqType == "peer" {
+		c.servePeer(w, r, parts)
 		return
 	}
 
 	if reqType == "get-addresses" {
-		var addresses []string
-		for address := range storage.items {
-			addresses = append(addresses, address)
-		}
-		slices.Sort(addresses)
-		result, _ = json.Marshal(addresses)
+		result, _ = json.Marshal(GetAddresses())
 		w.Header().Set("Content-Type", "application/json")
 		w.Write(result)
 		return
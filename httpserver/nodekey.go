@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+// nodeKey is the identity of the node. It signs the tree heads of the
+// transparency log and the receipts of accepted writes.
+var nodeKey ed25519.PrivateKey
+
+// loadNodeKey reads the PEM (PKCS #8) ed25519 key at path, creating it on
+// first start.
+func loadNodeKey(path string) (ed25519.PrivateKey, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, errors.New("node key: no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("node key: not an ed25519 key")
+	}
+	return privateKey, nil
+}
+
+func nodeID() string {
+	if nodeKey == nil {
+		return ""
+	}
+	return "0x" + hex.EncodeToString(nodeKey.Public().(ed25519.PublicKey))
+}
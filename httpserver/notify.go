@@ -0,0 +1,152 @@
+package httpserver
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	subscriberQueueSize = 64
+	recentEventsSize    = 1024
+)
+
+type Event struct {
+	ID      uint64
+	Address string
+	Item    *Item
+}
+
+type Subscriber struct {
+	addresses map[string]bool
+	Events    chan *Event
+}
+
+// Hub fans out accepted items to the subscribers of their addresses and
+// keeps the last events so that clients can resume after a reconnect.
+type Hub struct {
+	mtx         sync.Mutex
+	lastID      uint64
+	subscribers map[*Subscriber]struct{}
+	recent      []*Event
+}
+
+func NewHub() *Hub {
+	var c Hub
+	c.subscribers = make(map[*Subscriber]struct{})
+	// Ids keep growing across restarts, so a stale Last-Event-ID is
+	// never mistaken for a recent one.
+	c.lastID = uint64(time.Now().UnixMilli()) * 1000
+	return &c
+}
+
+var hub *Hub
+
+func init() {
+	hub = NewHub()
+}
+
+func (c *Hub) Subscribe(addresses []string) *Subscriber {
+	var s Subscriber
+	s.addresses = make(map[string]bool)
+	for _, address := range addresses {
+		s.addresses[address] = true
+	}
+	s.Events = make(chan *Event, subscriberQueueSize)
+	c.mtx.Lock()
+	c.subscribers[&s] = struct{}{}
+	c.mtx.Unlock()
+	return &s
+}
+
+// Watch adds addresses to the subscriber. It fails if the subscriber
+// would watch more than limit addresses.
+func (c *Hub) Watch(s *Subscriber, addresses []string, limit int) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	count := len(s.addresses)
+	for _, address := range addresses {
+		if !s.addresses[address] {
+			count++
+		}
+	}
+	if count > limit {
+		return false
+	}
+	for _, address := range addresses {
+		s.addresses[address] = true
+	}
+	return true
+}
+
+func (c *Hub) Unwatch(s *Subscriber, addresses []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, address := range addresses {
+		delete(s.addresses, address)
+	}
+}
+
+func (c *Hub) Unsubscribe(s *Subscriber) {
+	c.mtx.Lock()
+	if _, exists := c.subscribers[s]; exists {
+		delete(c.subscribers, s)
+		close(s.Events)
+	}
+	c.mtx.Unlock()
+}
+
+// Publish never blocks: a subscriber that does not keep up is dropped and
+// its channel is closed, the client is expected to resume by event id.
+func (c *Hub) Publish(item *Item) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastID++
+	ev := &Event{
+		ID:      c.lastID,
+		Address: "0x" + hex.EncodeToString(item.Address),
+		Item:    item,
+	}
+	c.recent = append(c.recent, ev)
+	if len(c.recent) > recentEventsSize {
+		c.recent = c.recent[len(c.recent)-recentEventsSize:]
+	}
+	for s := range c.subscribers {
+		if !s.addresses[ev.Address] {
+			continue
+		}
+		select {
+		case s.Events <- ev:
+		default:
+			delete(c.subscribers, s)
+			close(s.Events)
+		}
+	}
+}
+
+// Since returns the events of the addresses after the id. The result is
+// complete only if ok is true; otherwise older events are already gone.
+func (c *Hub) Since(id uint64, addresses []string) (events []*Event, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if id > c.lastID {
+		return nil, false
+	}
+	ok = len(c.recent) > 0 && c.recent[0].ID <= id+1 || id == c.lastID
+	filter := make(map[string]bool)
+	for _, address := range addresses {
+		filter[address] = true
+	}
+	for _, ev := range c.recent {
+		if ev.ID > id && filter[ev.Address] {
+			events = append(events, ev)
+		}
+	}
+	return events, ok
+}
+
+func (c *Hub) LastID() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lastID
+}
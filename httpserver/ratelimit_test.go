@@ -0,0 +1,58 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func proxiedRequest(peerIP string, clientIP string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = peerIP + ":40000"
+	r.Header.Set(proxiedHeader, "1")
+	r.Header.Set("X-Forwarded-For", "192.0.2.250, "+clientIP)
+	return r
+}
+
+func countLimited(c *HttpServer, requests func(i int) *http.Request) int {
+	limited := 0
+	for i := 0; i < 50; i++ {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, requests(i))
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	return limited
+}
+
+func TestRateLimitProxiedRequests(t *testing.T) {
+	c := NewHttpServer()
+	c.config.PlainHttp = true
+	c.peerIPs["198.51.100.1"] = true
+
+	// Clients behind a peer have their own buckets.
+	limited := countLimited(c, func(i int) *http.Request {
+		return proxiedRequest("198.51.100.1", "203.0.113."+strconv.Itoa(i))
+	})
+	if limited != 0 {
+		t.Fatal("requests of different clients limited:", limited)
+	}
+
+	// One client is limited however it reaches the node.
+	limited = countLimited(c, func(i int) *http.Request {
+		return proxiedRequest("198.51.100.1", "203.0.113.200")
+	})
+	if limited == 0 {
+		t.Fatal("a single client behind a peer is not limited")
+	}
+
+	// Only peers are trusted to name the client.
+	limited = countLimited(c, func(i int) *http.Request {
+		return proxiedRequest("198.51.100.2", "203.0.113."+strconv.Itoa(i))
+	})
+	if limited == 0 {
+		t.Fatal("a forged X-Forwarded-For escapes the limit")
+	}
+}
@@ -0,0 +1,182 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/topology"
+)
+
+const rebalanceAttempts = 8
+
+// RingUpdate is the body of /peer/ring: the new membership of the ring.
+// A node applies it only if the epoch is newer than its own. An update
+// without an epoch gets the current time; the node that receives it
+// first forwards it to every node of the old and the new ring.
+type RingUpdate struct {
+	Nodes     []string `json:"nodes"`
+	Epoch     int64    `json:"epoch"`
+	Forwarded bool     `json:"forwarded"`
+}
+
+type RingUpdateResult struct {
+	Applied bool  `json:"applied"`
+	Epoch   int64 `json:"epoch"`
+}
+
+// applyRing switches the node to the new ring membership and starts
+// moving the entries whose owners have changed.
+func (c *HttpServer) applyRing(req *RingUpdate) (*RingUpdateResult, error) {
+	if len(req.Nodes) == 0 {
+		return nil, errors.New("empty ring")
+	}
+	if req.Epoch == 0 {
+		req.Epoch = time.Now().UnixNano()
+	}
+	old, err := cluster.SetRing(req.Nodes, req.Epoch)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return &RingUpdateResult{Applied: false, Epoch: req.Epoch}, nil
+	}
+	logger.Println("Cluster ring changed:", old.Nodes(), "->", req.Nodes, "epoch", req.Epoch)
+
+	replicator.KeepPeers(cluster.Peers())
+	c.updatePeerIPs()
+
+	if !req.Forwarded {
+		targets := append(old.Nodes(), req.Nodes...)
+		slices.Sort(targets)
+		targets = slices.Compact(targets)
+		forward := RingUpdate{Nodes: req.Nodes, Epoch: req.Epoch, Forwarded: true}
+		for _, nodeUrl := range targets {
+			if nodeUrl != cluster.Self() {
+				go forwardRing(nodeUrl, &forward)
+			}
+		}
+	}
+
+	newRing := cluster.currentRing()
+	if !old.Equal(newRing) {
+		go rebalance(old, newRing)
+	}
+	return &RingUpdateResult{Applied: true, Epoch: req.Epoch}, nil
+}
+
+func forwardRing(nodeUrl string, req *RingUpdate) {
+	body, _ := json.Marshal(req)
+	client := &http.Client{Timeout: 5 * time.Second}
+	delay := time.Second
+	for attempt := 0; attempt < rebalanceAttempts; attempt++ {
+		resp, err := client.Post(nodeUrl+"/peer/ring", "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+			err = errors.New("peer returned status " + resp.Status)
+		}
+		logger.Println("Cluster forwarding ring to", nodeUrl, "error:", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// rebalance streams every entry to the owners it gained with the new
+// ring and drops the entries the node does not own any more once they
+// have been delivered.
+func rebalance(old *topology.Ring, newRing *topology.Ring) {
+	self := cluster.Self()
+	frames := make(map[string][][]byte)
+	targets := make(map[string][]string)
+	drop := make([]string, 0)
+
+	storage.mtx.Lock()
+	now := time.Now()
+	for key, entry := range storage.items {
+		item := syncItem(entry, now)
+		if item == nil {
+			continue
+		}
+		oldOwners := old.Owners(item.Address)
+		newOwners := newRing.Owners(item.Address)
+		for _, nodeUrl := range newOwners {
+			if nodeUrl != self && !slices.Contains(oldOwners, nodeUrl) {
+				f := frame.Frame{Address: item.Address, Signature: item.Signature, Payload: item.Data}
+				frames[nodeUrl] = append(frames[nodeUrl], f.Bytes())
+				targets[key] = append(targets[key], nodeUrl)
+			}
+		}
+		if !slices.Contains(newOwners, self) {
+			drop = append(drop, key)
+		}
+	}
+	storage.mtx.Unlock()
+
+	failed := make(map[string]bool)
+	moved := 0
+	var lastErr error
+	for nodeUrl, nodeFrames := range frames {
+		err := streamFrames(nodeUrl, nodeFrames)
+		if err != nil {
+			logger.Println("Cluster rebalance to", nodeUrl, "error:", err)
+			failed[nodeUrl] = true
+			lastErr = err
+			continue
+		}
+		moved += len(nodeFrames)
+	}
+
+	// An entry is kept until all its new owners have it.
+	drop = slices.DeleteFunc(drop, func(key string) bool {
+		return slices.ContainsFunc(targets[key], func(nodeUrl string) bool {
+			return failed[nodeUrl]
+		})
+	})
+	storage.dropEntries(drop)
+	logger.Println("Cluster rebalance: moved", moved, "frames, dropped", len(drop), "entries")
+
+	cluster.mtx.Lock()
+	cluster.rebalances++
+	cluster.moved += int64(moved)
+	cluster.dropped += int64(len(drop))
+	cluster.lastError = ""
+	if lastErr != nil {
+		cluster.lastError = lastErr.Error()
+	}
+	cluster.mtx.Unlock()
+}
+
+// streamFrames pushes the frames in batches. A batch is retried while the
+// peer rejects frames, as it may not have applied the new ring yet.
+func streamFrames(nodeUrl string, frames [][]byte) error {
+	for len(frames) > 0 {
+		batch := frames[:min(len(frames), replicationBatchSize)]
+		frames = frames[len(batch):]
+		delay := time.Second
+		var err error
+		for attempt := 0; attempt < rebalanceAttempts; attempt++ {
+			var result *PushResult
+			result, err = replicator.push(nodeUrl, batch)
+			if err == nil && result.Rejected > 0 {
+				err = errors.New("peer rejected frames")
+			}
+			if err == nil {
+				break
+			}
+			time.Sleep(delay)
+			delay = min(delay*2, 30*time.Second)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,377 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+)
+
+const (
+	replicationBatchSize = 100
+	maxPeerBodySize      = 4 * 1024 * 1024
+
+	// A frame refused by a peer this many times is given up; anti-entropy
+	// repairs it if the peer accepts it later.
+	replicationMaxRejects = 10
+)
+
+// PushRequest is the body of /peer/push: signed frames accepted by the
+// sending node.
+type PushRequest struct {
+	Frames [][]byte `json:"frames"`
+}
+
+// PushResult counts the pushed frames. RejectedFrames lists the indexes
+// of the refused ones in the request, so the sender can retry them;
+// LastReject is the error of the last of them.
+type PushResult struct {
+	Accepted       int    `json:"accepted"`
+	Ignored        int    `json:"ignored"`
+	Rejected       int    `json:"rejected"`
+	RejectedFrames []int  `json:"rejected_frames,omitempty"`
+	LastReject     string `json:"last_reject,omitempty"`
+}
+
+// queuedFrame is a frame waiting for a peer and the number of times the
+// peer has refused it.
+type queuedFrame struct {
+	bs      []byte
+	rejects int
+}
+
+// peerQueue holds the frames not yet delivered to one peer.
+type peerQueue struct {
+	mtx         sync.Mutex
+	url         string
+	frames      []queuedFrame
+	removed     int64
+	signal      chan struct{}
+	closed      bool
+	sent        int64
+	failures    int64
+	dropped     int64
+	rejected    int64
+	givenUp     int64
+	lastError   string
+	lastReject  string
+	lastSuccess time.Time
+}
+
+// Replicator forwards accepted frames to the replica peers asynchronously.
+// With the ring placement a frame goes only to the other owners of its
+// address.
+type Replicator struct {
+	mtx        sync.Mutex
+	peers      []*peerQueue
+	started    bool
+	maxQueue   int
+	retryDelay time.Duration
+	client     *http.Client
+}
+
+func NewReplicator(config Config) *Replicator {
+	var c Replicator
+	c.maxQueue = config.ReplicationQueueSize
+	c.retryDelay = time.Duration(config.ReplicationRetrySec) * time.Second
+	c.client = &http.Client{Timeout: 5 * time.Second}
+	return &c
+}
+
+var replicator = NewReplicator(DefaultConfig())
+
+func (c *Replicator) Start() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.started = true
+	for _, peer := range c.peers {
+		go c.thPeer(peer)
+	}
+}
+
+// peer returns the queue of the peer, creating it on first use.
+func (c *Replicator) peer(peerUrl string) *peerQueue {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, peer := range c.peers {
+		if peer.url == peerUrl {
+			return peer
+		}
+	}
+	peer := &peerQueue{
+		url:    peerUrl,
+		signal: make(chan struct{}, 1),
+	}
+	c.peers = append(c.peers, peer)
+	if c.started {
+		go c.thPeer(peer)
+	}
+	return peer
+}
+
+// KeepPeers stops the queues of the nodes that left the cluster.
+func (c *Replicator) KeepPeers(peerUrls []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.peers = slices.DeleteFunc(c.peers, func(peer *peerQueue) bool {
+		if slices.Contains(peerUrls, peer.url) {
+			return false
+		}
+		peer.mtx.Lock()
+		peer.closed = true
+		peer.frames = nil
+		peer.mtx.Unlock()
+		select {
+		case peer.signal <- struct{}{}:
+		default:
+		}
+		return true
+	})
+}
+
+// Enqueue never blocks. When a queue is full the oldest frame is dropped;
+// anti-entropy repairs what is lost this way.
+func (c *Replicator) Enqueue(frameBS []byte) {
+	peerUrls := cluster.Peers()
+	if len(frameBS) >= frame.AddressSize {
+		f := frame.Frame{Address: frameBS[:frame.AddressSize]}
+		if owners := cluster.Owners(f.AddressHex()); owners != nil {
+			peerUrls = slices.DeleteFunc(owners, func(nodeUrl string) bool {
+				return nodeUrl == cluster.Self()
+			})
+		}
+	}
+	for _, peerUrl := range peerUrls {
+		peer := c.peer(peerUrl)
+		peer.mtx.Lock()
+		peer.frames = append(peer.frames, queuedFrame{bs: frameBS})
+		if len(peer.frames) > c.maxQueue {
+			peer.frames = peer.frames[1:]
+			peer.removed++
+			peer.dropped++
+		}
+		peer.mtx.Unlock()
+		select {
+		case peer.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Replicator) thPeer(peer *peerQueue) {
+	delay := c.retryDelay
+	for {
+		peer.mtx.Lock()
+		if peer.closed {
+			peer.mtx.Unlock()
+			return
+		}
+		batch := peer.frames[:min(len(peer.frames), replicationBatchSize)]
+		removedBefore := peer.removed
+		peer.mtx.Unlock()
+
+		if len(batch) == 0 {
+			<-peer.signal
+			continue
+		}
+
+		frames := make([][]byte, 0, len(batch))
+		for _, f := range batch {
+			frames = append(frames, f.bs)
+		}
+		result, err := c.push(peer.url, frames)
+		peer.mtx.Lock()
+		if err != nil {
+			peer.failures++
+			peer.lastError = err.Error()
+		} else if !peer.closed {
+			// Some frames of the batch may have been dropped meanwhile.
+			dropped := int(peer.removed - removedBefore)
+			n := len(batch) - dropped
+			if n > 0 {
+				retry := c.rejectedFrames(peer, batch, dropped, result)
+				peer.frames = append(retry, peer.frames[n:]...)
+				peer.removed += int64(n)
+			}
+			peer.sent += int64(len(batch) - len(result.RejectedFrames))
+			peer.lastSuccess = time.Now()
+			peer.lastError = ""
+		}
+		peer.mtx.Unlock()
+
+		if err == nil && result.Rejected > 0 {
+			logger.Println("Replicator push to", peer.url, "rejected", result.Rejected, "frames:", result.LastReject)
+		}
+		if err != nil || result.Rejected > 0 {
+			if err != nil {
+				logger.Println("Replicator push to", peer.url, "error:", err)
+			}
+			time.Sleep(delay)
+			delay = min(delay*2, 64*c.retryDelay)
+			continue
+		}
+		delay = c.retryDelay
+	}
+}
+
+// rejectedFrames returns the frames of the batch the peer refused, to be
+// sent again, and gives up the ones refused too often. The first dropped
+// frames of the batch are no longer queued. Must be called under
+// peer.mtx.
+func (c *Replicator) rejectedFrames(peer *peerQueue, batch []queuedFrame, dropped int, result *PushResult) []queuedFrame {
+	retry := make([]queuedFrame, 0)
+	peer.rejected += int64(result.Rejected)
+	if result.LastReject != "" {
+		peer.lastReject = result.LastReject
+	}
+	for _, i := range result.RejectedFrames {
+		if i < dropped || i >= len(batch) {
+			continue
+		}
+		rejects := batch[i].rejects + 1
+		if rejects >= replicationMaxRejects {
+			peer.givenUp++
+			continue
+		}
+		retry = append(retry, queuedFrame{bs: batch[i].bs, rejects: rejects})
+	}
+	return retry
+}
+
+func (c *Replicator) push(peerUrl string, frames [][]byte) (*PushResult, error) {
+	body, err := json.Marshal(PushRequest{Frames: frames})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(peerUrl+"/peer/push", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBS, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("peer returned status " + resp.Status + ": " + string(respBS))
+	}
+	var result PushResult
+	err = json.Unmarshal(respBS, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Replicator) BuildDebugInfo() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	info := "Replication Debug Info:\n"
+	for _, peer := range c.peers {
+		peer.mtx.Lock()
+		lastSuccess := "never"
+		if !peer.lastSuccess.IsZero() {
+			lastSuccess = peer.lastSuccess.UTC().Format("2006-01-02 15:04:05.000")
+		}
+		info += fmt.Sprintf("  Peer: %s, Queue: %d, Sent: %d, Failures: %d, Dropped: %d, Rejected: %d, Given up: %d, Last success: %s",
+			peer.url, len(peer.frames), peer.sent, peer.failures, peer.dropped, peer.rejected, peer.givenUp, lastSuccess)
+		if peer.lastError != "" {
+			info += ", Last error: " + peer.lastError
+		}
+		if peer.lastReject != "" {
+			info += ", Last reject: " + peer.lastReject
+		}
+		info += "\n"
+		peer.mtx.Unlock()
+	}
+	return info
+}
+
+// PushData stores frames forwarded by a peer. Conflicts are resolved by
+// the signed timestamp: frames not newer than the stored ones are ignored.
+func PushData(req *PushRequest) *PushResult {
+	var result PushResult
+	for i, frameBS := range req.Frames {
+		_, err := setData(frameBS, true)
+		switch {
+		case err == nil:
+			result.Accepted++
+		case errors.Is(err, ErrStaleFrame):
+			result.Ignored++
+		default:
+			result.Rejected++
+			result.RejectedFrames = append(result.RejectedFrames, i)
+			result.LastReject = err.Error()
+		}
+	}
+	return &result
+}
+
+// servePeer handles the node-to-node API under /peer/. Pushed frames skip
+// the checks of client writes, so only peers and the local host may call
+// it.
+func (c *HttpServer) servePeer(w http.ResponseWriter, r *http.Request, parts []string) {
+	ip := net.ParseIP(clientIP(r))
+	if !c.isPeer(clientIP(r)) && (ip == nil || !ip.IsLoopback()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("wrong request: the peer api is available to peers only"))
+		return
+	}
+	op := ""
+	if len(parts) > 1 {
+		op = parts[1]
+	}
+
+	var result any
+	var err error
+	switch op {
+	case "push":
+		var req PushRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			result = PushData(&req)
+		}
+	case "digest":
+		var req DigestRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			result = DigestResult{Ranges: storage.rangeDigests(req.Prefix)}
+		}
+	case "entries":
+		var req DigestRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			result = EntriesResult{Entries: storage.rangeEntries(req.Prefix)}
+		}
+	case "frames":
+		var req FramesRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			result = FramesResult{Frames: storage.entryFrames(req.Entries)}
+		}
+	case "ring":
+		var req RingUpdate
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err == nil {
+			result, err = c.applyRing(&req)
+		}
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("wrong request: unknown peer operation"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("wrong request: api - " + err.Error()))
+		return
+	}
+	bs, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
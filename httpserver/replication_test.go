@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeerBodySize(t *testing.T) {
+	c := NewHttpServer()
+	c.config.PlainHttp = true
+	c.peerIPs["198.51.100.1"] = true
+	body := `{"prefix":"` + strings.Repeat("0", 64*1024) + `"}`
+
+	serve := func(ip string) int {
+		r := httptest.NewRequest(http.MethodPost, "/peer/digest", strings.NewReader(body))
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := serve("198.51.100.1"); code != http.StatusOK {
+		t.Fatal("a large body of a peer refused:", code)
+	}
+	if code := serve("198.51.100.2"); code == http.StatusOK {
+		t.Fatal("a large body of another client accepted")
+	}
+}
+
+func TestPeerAPIForPeersOnly(t *testing.T) {
+	c := NewHttpServer()
+	c.config.PlainHttp = true
+	c.peerIPs["198.51.100.1"] = true
+
+	for _, op := range []string{"push", "digest", "entries", "frames", "ring"} {
+		r := httptest.NewRequest(http.MethodPost, "/peer/"+op, strings.NewReader("{}"))
+		r.RemoteAddr = "198.51.100.2:40000"
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Fatal(op, "from a client answered", w.Code)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/peer/digest", strings.NewReader("{}"))
+	r.RemoteAddr = "198.51.100.1:40000"
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("digest from a peer answered", w.Code)
+	}
+}
+
+func TestRejectedFramesRequeued(t *testing.T) {
+	c := NewReplicator(DefaultConfig())
+	peer := &peerQueue{}
+	batch := []queuedFrame{
+		{bs: []byte("dropped")},
+		{bs: []byte("accepted")},
+		{bs: []byte("refused")},
+		{bs: []byte("refused too often"), rejects: replicationMaxRejects - 1},
+	}
+	result := &PushResult{Rejected: 3, RejectedFrames: []int{0, 2, 3, 7}, LastReject: "wrong shard"}
+	retry := c.rejectedFrames(peer, batch, 1, result)
+	if len(retry) != 1 || string(retry[0].bs) != "refused" || retry[0].rejects != 1 {
+		t.Fatal("unexpected frames to retry:", retry)
+	}
+	if peer.rejected != 3 || peer.givenUp != 1 || peer.lastReject != "wrong shard" {
+		t.Fatal("unexpected counters:", peer.rejected, peer.givenUp, peer.lastReject)
+	}
+}
@@ -0,0 +1,239 @@
+package httpserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/merkle"
+)
+
+// TransparencyLog is the append-only Merkle log of all frames the node
+// has accepted, in the order of acceptance. The leaf hashes are kept in
+// merkle.dat of the data directory.
+type TransparencyLog struct {
+	mtx    sync.Mutex
+	tree   *merkle.Tree
+	leaves map[string]uint64
+	file   *os.File
+	dirty  bool
+	policy string
+}
+
+type InclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+type ConsistencyProof struct {
+	First       uint64   `json:"first"`
+	Second      uint64   `json:"second"`
+	Consistency [][]byte `json:"consistency"`
+}
+
+func NewTransparencyLog() *TransparencyLog {
+	var c TransparencyLog
+	c.tree = merkle.NewTree()
+	c.leaves = make(map[string]uint64)
+	return &c
+}
+
+var translog = NewTransparencyLog()
+
+func (c *TransparencyLog) Open(path string, policy string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var err error
+	c.policy = policy
+	c.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	bs, err := io.ReadAll(c.file)
+	if err != nil {
+		return err
+	}
+	valid := len(bs) - len(bs)%merkle.HashSize
+	if valid != len(bs) {
+		logger.Println("TransparencyLog truncating partial leaf at", valid)
+		err = c.file.Truncate(int64(valid))
+		if err != nil {
+			return err
+		}
+	}
+	for offset := 0; offset < valid; offset += merkle.HashSize {
+		leafHash := bs[offset : offset+merkle.HashSize]
+		c.leaves[string(leafHash)] = c.tree.Append(leafHash)
+	}
+	_, err = c.file.Seek(int64(valid), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	logger.Println("TransparencyLog opened,", c.tree.Size(), "leaves")
+	return nil
+}
+
+func (c *TransparencyLog) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Sync()
+	c.file.Close()
+	c.file = nil
+	return err
+}
+
+// Append logs an accepted frame and returns its leaf index.
+func (c *TransparencyLog) Append(frameBS []byte) (uint64, []byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	leafHash := merkle.LeafHash(frameBS)
+	if c.file != nil {
+		_, err := c.file.Write(leafHash)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.policy == FsyncAlways {
+			err = c.file.Sync()
+			if err != nil {
+				return 0, nil, err
+			}
+		} else {
+			c.dirty = true
+		}
+	}
+	index := c.tree.Append(leafHash)
+	if _, exists := c.leaves[string(leafHash)]; !exists {
+		c.leaves[string(leafHash)] = index
+	}
+	return index, leafHash, nil
+}
+
+// Lookup returns the leaf index of a logged frame.
+func (c *TransparencyLog) Lookup(frameBS []byte) (uint64, []byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	leafHash := merkle.LeafHash(frameBS)
+	index, exists := c.leaves[string(leafHash)]
+	return index, leafHash, exists
+}
+
+// TreeHead signs the current root. The leaves are synced first, so a
+// signed tree head never covers leaves that a crash could lose.
+func (c *TransparencyLog) TreeHead() (*merkle.TreeHead, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if nodeKey == nil {
+		return nil, errors.New("node key is not loaded")
+	}
+	if c.file != nil && c.dirty {
+		err := c.file.Sync()
+		if err != nil {
+			return nil, err
+		}
+		c.dirty = false
+	}
+	var head merkle.TreeHead
+	head.TreeSize = c.tree.Size()
+	head.Timestamp = time.Now().UnixMilli()
+	head.RootHash, _ = c.tree.Root(head.TreeSize)
+	head.Sign(nodeKey)
+	return &head, nil
+}
+
+// InclusionProof finds the leaf by its hash (hex) and proves it is in the
+// tree of treeSize leaves.
+func (c *TransparencyLog) InclusionProof(leafHashHex string, treeSize uint64) (*InclusionProof, error) {
+	leafHash, err := hex.DecodeString(strings.TrimPrefix(leafHashHex, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	index, exists := c.leaves[string(leafHash)]
+	if !exists || index >= treeSize {
+		return nil, ErrLeafNotFound
+	}
+	path, err := c.tree.InclusionProof(index, treeSize)
+	if err != nil {
+		return nil, err
+	}
+	return &InclusionProof{LeafIndex: index, TreeSize: treeSize, AuditPath: path}, nil
+}
+
+func (c *TransparencyLog) ConsistencyProof(first uint64, second uint64) (*ConsistencyProof, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	path, err := c.tree.ConsistencyProof(first, second)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsistencyProof{First: first, Second: second, Consistency: path}, nil
+}
+
+func (c *TransparencyLog) Size() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.tree.Size()
+}
+
+// serveLog handles /v1/log/sth, /v1/log/inclusion?hash=&tree_size= and
+// /v1/log/consistency?first=&second=.
+func (c *HttpServer) serveLog(w http.ResponseWriter, r *http.Request, parts []string) {
+	op := ""
+	if len(parts) > 2 {
+		op = parts[2]
+	}
+	query := r.URL.Query()
+
+	var result any
+	var err error
+	switch op {
+	case "sth":
+		result, err = translog.TreeHead()
+	case "inclusion":
+		treeSize := translog.Size()
+		if s := query.Get("tree_size"); s != "" {
+			treeSize, err = strconv.ParseUint(s, 10, 64)
+		}
+		if err == nil {
+			result, err = translog.InclusionProof(query.Get("hash"), treeSize)
+		}
+	case "consistency":
+		var first, second uint64
+		first, err = strconv.ParseUint(query.Get("first"), 10, 64)
+		if err == nil {
+			second, err = strconv.ParseUint(query.Get("second"), 10, 64)
+		}
+		if err == nil {
+			result, err = translog.ConsistencyProof(first, second)
+		}
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("wrong request: unknown log operation"))
+		return
+	}
+	if err != nil {
+		status := errorStatus(err)
+		if status == http.StatusInternalServerError && op != "sth" {
+			status = http.StatusBadRequest
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("wrong request: api - " + err.Error()))
+		return
+	}
+	bs, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
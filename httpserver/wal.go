@@ -0,0 +1,268 @@
+package httpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+// Every record in the log and in the snapshot file is
+// [length uint32][crc32 uint32][payload], big endian.
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 1024 * 1024
+)
+
+type WAL struct {
+	mtx    sync.Mutex
+	path   string
+	file   *os.File
+	policy string
+	dirty  bool
+	size   int64
+	stop   chan struct{}
+}
+
+func OpenWAL(path string, policy string, interval time.Duration) (*WAL, error) {
+	var c WAL
+	var err error
+	c.path = path
+	c.policy = policy
+	c.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	st, err := c.file.Stat()
+	if err != nil {
+		c.file.Close()
+		return nil, err
+	}
+	c.size = st.Size()
+	c.stop = make(chan struct{})
+	if policy == FsyncInterval {
+		go c.thSync(interval)
+	}
+	return &c, nil
+}
+
+func encodeRecord(payload []byte) []byte {
+	rec := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(payload))
+	copy(rec[recordHeaderSize:], payload)
+	return rec
+}
+
+func (c *WAL) Append(payload []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil {
+		return errors.New("wal is closed")
+	}
+	rec := encodeRecord(payload)
+	_, err := c.file.Write(rec)
+	if err != nil {
+		return err
+	}
+	c.size += int64(len(rec))
+	if c.policy == FsyncAlways {
+		return c.file.Sync()
+	}
+	c.dirty = true
+	return nil
+}
+
+func (c *WAL) Size() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.size
+}
+
+func (c *WAL) Sync() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil || !c.dirty {
+		return nil
+	}
+	c.dirty = false
+	return c.file.Sync()
+}
+
+// Reset drops all records. Called once their content is in a snapshot.
+func (c *WAL) Reset() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil {
+		return errors.New("wal is closed")
+	}
+	err := c.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	c.size = 0
+	c.dirty = false
+	return c.file.Sync()
+}
+
+func (c *WAL) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	close(c.stop)
+	err := c.file.Sync()
+	c.file.Close()
+	c.file = nil
+	return err
+}
+
+func (c *WAL) thSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			err := c.Sync()
+			if err != nil {
+				logger.Println("WAL sync error:", err)
+			}
+		}
+	}
+}
+
+// ErrCorruptRecords means that the file is damaged before its end, so
+// the records after the damage can not be read.
+var ErrCorruptRecords = errors.New("corrupt records")
+
+// ReadRecords calls fn for every valid record of the file and returns the
+// offset right after the last well-formed record. Records with a wrong
+// checksum are skipped. A tail shorter than the record it starts is a
+// write torn by a crash and stops the reading; any other damage stops it
+// with ErrCorruptRecords.
+func ReadRecords(path string, fn func(payload []byte)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	mismatch := false
+	header := make([]byte, recordHeaderSize)
+	// torn reports the end of the file at offset. After a checksum
+	// mismatch the reader may be out of step with the records, so a short
+	// tail is not trusted to be a torn write.
+	torn := func(reason string) (int64, error) {
+		logger.Println("ReadRecords", path, reason, "at offset", offset)
+		if mismatch {
+			return offset, ErrCorruptRecords
+		}
+		return offset, nil
+	}
+	for {
+		_, err = io.ReadFull(r, header)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return torn("truncated record header")
+		}
+		if err != nil {
+			return offset, err
+		}
+		size := binary.BigEndian.Uint32(header[0:])
+		checksum := binary.BigEndian.Uint32(header[4:])
+		if size > maxRecordSize {
+			logger.Println("ReadRecords", path, "invalid record size", size, "at offset", offset)
+			return offset, ErrCorruptRecords
+		}
+		if offset+int64(recordHeaderSize)+int64(size) > st.Size() {
+			return torn("truncated record")
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			return offset, err
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			logger.Println("ReadRecords", path, "checksum mismatch at offset", offset, "- record skipped")
+			mismatch = true
+		} else {
+			fn(payload)
+		}
+		offset += int64(recordHeaderSize) + int64(size)
+	}
+}
+
+// setAside keeps a damaged file as path.corrupt-<time> for recovery and
+// puts its first validSize bytes back at path.
+func setAside(path string, validSize int64) error {
+	asidePath := path + ".corrupt-" + time.Now().UTC().Format("20060102150405")
+	err := os.Rename(path, asidePath)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(asidePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, src, validSize)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		return err
+	}
+	logger.Println("ReadRecords", path, "is damaged, kept as", asidePath)
+	return nil
+}
+
+// WriteSnapshot atomically replaces the file at path with the records.
+func WriteSnapshot(path string, payloads [][]byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, payload := range payloads {
+		_, err = w.Write(encodeRecord(payload))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
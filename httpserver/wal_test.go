@@ -0,0 +1,341 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testItem(name string, n int) *Item {
+	now := time.Now().UTC()
+	return &Item{
+		Address:    bytes.Repeat([]byte{0x42}, 32),
+		Data:       []byte("value " + strconv.Itoa(n)),
+		Name:       name,
+		Time:       now.Add(time.Duration(n) * time.Millisecond),
+		Version:    uint64(n),
+		ReceivedAt: now,
+		ExpiresAt:  now.Add(time.Hour),
+	}
+}
+
+func testStorageConfig(dir string) Config {
+	config := DefaultConfig()
+	config.DataDir = dir
+	config.FsyncPolicy = FsyncAlways
+	config.SnapshotIntervalSec = 0
+	return config
+}
+
+func openTestStorage(t *testing.T, dir string) *Storage {
+	t.Helper()
+	s := NewStorage()
+	err := s.Open(testStorageConfig(dir))
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	return s
+}
+
+func writeTestItem(t *testing.T, s *Storage, item *Item) {
+	t.Helper()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	err := s.apply(item)
+	if err == nil {
+		err = s.logItem(item)
+	}
+	if err != nil {
+		t.Fatal("write:", err)
+	}
+}
+
+// crash stops the storage without the snapshot that Close writes.
+func crash(s *Storage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	close(s.stop)
+	s.wal.Close()
+	s.wal = nil
+}
+
+func latestData(s *Storage, name string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	entry := s.items[itemKey(testItem(name, 0))]
+	if entry == nil {
+		return ""
+	}
+	return string(entry.Latest().Data)
+}
+
+// writeTestRecords writes the records to a new log file and returns the
+// offset of every record.
+func writeTestRecords(t *testing.T, path string, payloads ...string) []int64 {
+	t.Helper()
+	wal, err := OpenWAL(path, FsyncNever, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	offsets := make([]int64, 0, len(payloads))
+	for _, payload := range payloads {
+		offsets = append(offsets, wal.Size())
+		err = wal.Append([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return offsets
+}
+
+func readTestRecords(t *testing.T, path string) ([]string, int64, error) {
+	t.Helper()
+	var payloads []string
+	validSize, err := ReadRecords(path, func(payload []byte) {
+		payloads = append(payloads, string(payload))
+	})
+	return payloads, validSize, err
+}
+
+func appendBytes(t *testing.T, path string, bs []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func patchBytes(t *testing.T, path string, offset int64, bs []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteAt(bs, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.dat")
+	writeTestRecords(t, path, "one", "two", "three")
+	st, _ := os.Stat(path)
+
+	payloads, validSize, err := readTestRecords(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 3 || payloads[0] != "one" || payloads[2] != "three" {
+		t.Fatal("unexpected records:", payloads)
+	}
+	if validSize != st.Size() {
+		t.Fatal("valid size", validSize, "file size", st.Size())
+	}
+
+	_, validSize, err = readTestRecords(t, filepath.Join(t.TempDir(), "missing.dat"))
+	if err != nil || validSize != 0 {
+		t.Fatal("missing file:", validSize, err)
+	}
+}
+
+func TestReadRecordsTornTail(t *testing.T) {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint32(header, 100)
+	tails := map[string][]byte{
+		"header":  header[:3],
+		"payload": append(header, "short"...),
+	}
+	for tailName, tail := range tails {
+		path := filepath.Join(t.TempDir(), "wal.dat")
+		writeTestRecords(t, path, "one", "two")
+		st, _ := os.Stat(path)
+		appendBytes(t, path, tail)
+
+		payloads, validSize, err := readTestRecords(t, path)
+		if err != nil {
+			t.Fatal(tailName, err)
+		}
+		if len(payloads) != 2 || validSize != st.Size() {
+			t.Fatal(tailName, "unexpected records:", payloads, validSize)
+		}
+	}
+}
+
+func TestReadRecordsChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.dat")
+	offsets := writeTestRecords(t, path, "one", "two", "three")
+	patchBytes(t, path, offsets[1]+recordHeaderSize, []byte("X"))
+
+	payloads, _, err := readTestRecords(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 2 || payloads[0] != "one" || payloads[1] != "three" {
+		t.Fatal("unexpected records:", payloads)
+	}
+}
+
+func TestReadRecordsCorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.dat")
+	offsets := writeTestRecords(t, path, "one", "two", "three")
+	patchBytes(t, path, offsets[1], []byte{0xff, 0xff, 0xff, 0xff})
+
+	payloads, validSize, err := readTestRecords(t, path)
+	if !errors.Is(err, ErrCorruptRecords) {
+		t.Fatal("expected ErrCorruptRecords, got", err)
+	}
+	if len(payloads) != 1 || validSize != offsets[1] {
+		t.Fatal("unexpected records:", payloads, validSize)
+	}
+
+	// A shorter length leaves the reader out of step with the records.
+	path = filepath.Join(t.TempDir(), "wal.dat")
+	offsets = writeTestRecords(t, path, "one", "two", "three")
+	patchBytes(t, path, offsets[1], []byte{0, 0, 0, 1})
+	_, _, err = readTestRecords(t, path)
+	if !errors.Is(err, ErrCorruptRecords) {
+		t.Fatal("expected ErrCorruptRecords for a short length, got", err)
+	}
+}
+
+func TestStorageReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	writeTestItem(t, s, testItem("a", 1))
+	err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestItem(t, s, testItem("a", 2))
+	writeTestItem(t, s, testItem("b", 3))
+	crash(s)
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	if len(s.items) != 2 {
+		t.Fatal("entries after restart:", len(s.items))
+	}
+	if data := latestData(s, "a"); data != "value 2" {
+		t.Fatal("entry a after restart:", data)
+	}
+	if data := latestData(s, "b"); data != "value 3" {
+		t.Fatal("entry b after restart:", data)
+	}
+	if history := s.items[itemKey(testItem("a", 0))].History; len(history) != 2 {
+		t.Fatal("history of a after restart:", len(history))
+	}
+}
+
+func TestStorageTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	writeTestItem(t, s, testItem("a", 1))
+	crash(s)
+	walPath := filepath.Join(dir, "wal.dat")
+	st, _ := os.Stat(walPath)
+	appendBytes(t, walPath, []byte{0, 0, 1})
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	if data := latestData(s, "a"); data != "value 1" {
+		t.Fatal("entry a after restart:", data)
+	}
+	truncated, _ := os.Stat(walPath)
+	if truncated.Size() != st.Size() {
+		t.Fatal("wal size", truncated.Size(), "expected", st.Size())
+	}
+}
+
+func TestStorageKeepsCorruptWAL(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	writeTestItem(t, s, testItem("a", 1))
+	offset := s.wal.Size()
+	writeTestItem(t, s, testItem("b", 2))
+	writeTestItem(t, s, testItem("c", 3))
+	crash(s)
+	walPath := filepath.Join(dir, "wal.dat")
+	original, _ := os.ReadFile(walPath)
+	patchBytes(t, walPath, offset, []byte{0xff, 0xff, 0xff, 0xff})
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	if data := latestData(s, "a"); data != "value 1" {
+		t.Fatal("entry a after restart:", data)
+	}
+
+	matches, _ := filepath.Glob(walPath + ".corrupt-*")
+	if len(matches) != 1 {
+		t.Fatal("corrupt copies:", matches)
+	}
+	kept, _ := os.ReadFile(matches[0])
+	if len(kept) != len(original) || !bytes.Equal(kept[offset+4:], original[offset+4:]) {
+		t.Fatal("the records after the damage are not kept")
+	}
+	st, _ := os.Stat(walPath)
+	if st.Size() != offset {
+		t.Fatal("wal size", st.Size(), "expected", offset)
+	}
+}
+
+func TestStorageReplaysRemovals(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	s.config.MaxEntries = 2
+	s.config.PreferKnown = false
+	writeTestItem(t, s, testItem("a", 1))
+	writeTestItem(t, s, testItem("b", 2))
+	writeTestItem(t, s, testItem("c", 3))
+	expiring := testItem("d", 4)
+	expiring.ExpiresAt = expiring.ReceivedAt.Add(time.Second)
+	s.config.MaxEntries = 0
+	writeTestItem(t, s, expiring)
+	s.Sweep(expiring.ExpiresAt.Add(time.Second))
+	if len(s.items) != 2 {
+		t.Fatal("entries before restart:", len(s.items))
+	}
+	// An expired name written again keeps its new value.
+	writeTestItem(t, s, testItem("e", 5))
+	expiringAgain := testItem("e", 6)
+	expiringAgain.ExpiresAt = expiring.ExpiresAt
+	s.mtx.Lock()
+	s.remove(itemKey(expiringAgain), &expiredRecord{Time: expiringAgain.Time, ExpiredAt: expiringAgain.ExpiresAt})
+	s.mtx.Unlock()
+	writeTestItem(t, s, testItem("e", 7))
+	err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(s)
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	if len(s.items) != 3 {
+		t.Fatal("entries after restart:", len(s.items))
+	}
+	if data := latestData(s, "e"); data != "value 7" {
+		t.Fatal("entry written after it expired:", data)
+	}
+	if data := latestData(s, "a"); data != "" {
+		t.Fatal("evicted entry is back:", data)
+	}
+	if data := latestData(s, "d"); data != "" {
+		t.Fatal("expired entry is back:", data)
+	}
+	if _, exists := s.expired[itemKey(expiring)]; !exists {
+		t.Fatal("expired entry is not remembered")
+	}
+}
@@ -0,0 +1,154 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+const (
+	maxWatchAddresses = 32
+	watchWriteTimeout = 10 * time.Second
+)
+
+func (c *HttpServer) acquireWatcher(ip string) bool {
+	c.mtxClients.Lock()
+	defer c.mtxClients.Unlock()
+	if c.watchers[ip] >= c.config.MaxWatchersPerIP {
+		return false
+	}
+	c.watchers[ip]++
+	return true
+}
+
+func (c *HttpServer) releaseWatcher(ip string) {
+	c.mtxClients.Lock()
+	defer c.mtxClients.Unlock()
+	c.watchers[ip]--
+	if c.watchers[ip] <= 0 {
+		delete(c.watchers, ip)
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id uint64, item *Item) error {
+	eventType := "update"
+	if item.Deleted {
+		eventType = "delete"
+	}
+	data, _ := json.Marshal(NewEntryView(item))
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, eventType, data)
+	return err
+}
+
+// serveWatch streams accepted items of the addresses as Server-Sent Events:
+// /watch/{address}[,address...]
+func (c *HttpServer) serveWatch(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) < 2 {
+		w.WriteHeader(500)
+		w.Write([]byte("wrong request: api - missing argument"))
+		return
+	}
+	addresses := make([]string, 0)
+	for _, address := range strings.Split(parts[1], ",") {
+		if address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 || len(addresses) > maxWatchAddresses {
+		w.WriteHeader(400)
+		w.Write([]byte("wrong request: api - wrong number of addresses"))
+		return
+	}
+	if address := cluster.foreignAddress(addresses); address != "" {
+		w.WriteHeader(ErrWrongShard.Status)
+		w.Write([]byte("wrong request: api - " + ErrWrongShard.Error() + ": " + address))
+		return
+	}
+
+	ip := clientIP(r)
+	if !c.acquireWatcher(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many watchers, please try again later."))
+		return
+	}
+	defer c.releaseWatcher(ip)
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	sub := hub.Subscribe(addresses)
+	defer hub.Unsubscribe(sub)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	// The current values go first unless the client resumes within the
+	// events still kept by the hub.
+	lastSent := uint64(0)
+	resumed := false
+	if lastEventID != "" {
+		if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+			events, ok := hub.Since(id, addresses)
+			if ok {
+				resumed = true
+				for _, ev := range events {
+					if writeEvent(w, ev.ID, ev.Item) != nil {
+						return
+					}
+					lastSent = ev.ID
+				}
+			}
+		}
+	}
+	if !resumed {
+		lastSent = hub.LastID()
+		for _, address := range addresses {
+			for _, item := range GetAddressItems(address) {
+				if writeEvent(w, lastSent, item) != nil {
+					return
+				}
+			}
+		}
+	}
+	rc.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(c.config.WatchHeartbeatSec) * time.Second)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.Events:
+			if !ok {
+				logger.Println("HttpServer watch subscriber dropped:", ip)
+				return
+			}
+			if ev.ID <= lastSent {
+				continue
+			}
+			rc.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+			err = writeEvent(w, ev.ID, ev.Item)
+			lastSent = ev.ID
+		case <-heartbeat.C:
+			rc.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+			_, err = w.Write([]byte(": heartbeat\n\n"))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
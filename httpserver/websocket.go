@@ -0,0 +1,223 @@
+package httpserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal RFC 6455 server side: handshake, framing, fragmentation and
+// control frames. No extensions.
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+
+	wsMaxMessageSize = 64 * 1024
+	wsWriteTimeout   = 10 * time.Second
+)
+
+var (
+	errWsProtocol = errors.New("websocket protocol error")
+	errWsTooLarge = errors.New("websocket message too large")
+)
+
+type wsConn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	mtxWrite    sync.Mutex
+	readTimeout time.Duration
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the
+// connection. On failure the error response is already written.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	var err error
+	key := r.Header.Get("Sec-WebSocket-Key")
+	hijacker, canHijack := w.(http.Hijacker)
+	switch {
+	case r.Method != "GET" || !isWebSocketUpgrade(r):
+		err = errors.New("not a websocket handshake")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err = errors.New("unsupported websocket version")
+	case key == "":
+		err = errors.New("missing Sec-WebSocket-Key")
+	case !canHijack:
+		err = errors.New("connection can not be hijacked")
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("wrong request: api - " + err.Error()))
+		return nil, err
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// Drop the deadlines of the http server.
+	conn.SetDeadline(time.Time{})
+
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: brw.Reader}, nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	c.mtxWrite.Lock()
+	defer c.mtxWrite.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+func (c *wsConn) close(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	c.writeFrame(wsOpClose, payload)
+	c.conn.Close()
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	header := make([]byte, 2)
+	_, err = io.ReadFull(c.reader, header)
+	if err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		err = errWsProtocol
+		return
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if !masked {
+		// Client frames must be masked.
+		err = errWsProtocol
+		return
+	}
+	size := uint64(header[1] & 0x7F)
+	switch size {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, ext)
+		size = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, ext)
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return
+	}
+	if opcode >= wsOpClose && (size > 125 || !fin) {
+		err = errWsProtocol
+		return
+	}
+	if size > wsMaxMessageSize {
+		err = errWsTooLarge
+		return
+	}
+	mask := make([]byte, 4)
+	_, err = io.ReadFull(c.reader, mask)
+	if err != nil {
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// readMessage returns the next complete data message. Pings are answered
+// and pongs are consumed on the way; a close frame gives io.EOF.
+func (c *wsConn) readMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.close(1000, "")
+			return 0, nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if opcode != 0 {
+				return 0, nil, errWsProtocol
+			}
+			opcode = op
+			message = payload
+		case wsOpContinuation:
+			if opcode == 0 {
+				return 0, nil, errWsProtocol
+			}
+			if len(message)+len(payload) > wsMaxMessageSize {
+				return 0, nil, errWsTooLarge
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, errWsProtocol
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
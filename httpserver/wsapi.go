@@ -0,0 +1,155 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"golang.org/x/time/rate"
+)
+
+// Messages of the /ws endpoint. Text messages are JSON wsRequest objects;
+// a binary message is a signed frame to store, like a POST to /set.
+//
+//	{"op":"subscribe","id":"1","addresses":["0x..."]}
+//	{"op":"unsubscribe","id":"2","addresses":["0x..."]}
+//	{"op":"set","id":"3","frame":"<base64 signed frame>"}
+type wsRequest struct {
+	Op        string   `json:"op"`
+	ID        string   `json:"id,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	Frame     []byte   `json:"frame,omitempty"`
+}
+
+type wsResponse struct {
+	Op      string     `json:"op"`
+	ID      string     `json:"id,omitempty"`
+	EventID uint64     `json:"event_id,omitempty"`
+	Entry   *EntryView `json:"entry,omitempty"`
+	Version uint64     `json:"version,omitempty"`
+	Code    string     `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+func (c *wsConn) writeJSON(v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, bs)
+}
+
+func wsError(id string, err error) *wsResponse {
+	code := "error"
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		code = apiErr.Code
+	}
+	return &wsResponse{Op: "error", ID: id, Code: code, Message: err.Error()}
+}
+
+func (c *HttpServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if !c.acquireWatcher(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many watchers, please try again later."))
+		return
+	}
+	defer c.releaseWatcher(ip)
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		logger.Println("HttpServer ws upgrade error:", ip, err)
+		return
+	}
+	defer ws.conn.Close()
+
+	pingInterval := time.Duration(c.config.WsPingSec) * time.Second
+	ws.readTimeout = 2 * pingInterval
+	limiter := rate.NewLimiter(rate.Limit(c.config.WsMessagesPerSec), c.config.WsBurst)
+
+	sub := hub.Subscribe(nil)
+	defer hub.Unsubscribe(sub)
+
+	done := make(chan struct{})
+	defer close(done)
+	go c.thWebSocketWriter(ws, sub, pingInterval, done)
+
+	for {
+		opcode, message, err := ws.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				logger.Println("HttpServer ws read error:", ip, err)
+				ws.close(1002, "")
+			}
+			return
+		}
+		if !limiter.Allow() {
+			ws.writeJSON(&wsResponse{Op: "error", Code: "rate_limited", Message: "too many messages"})
+			continue
+		}
+
+		var req wsRequest
+		if opcode == wsOpBinary {
+			req.Op = "set"
+			req.Frame = message
+		} else if err := json.Unmarshal(message, &req); err != nil {
+			ws.writeJSON(&wsResponse{Op: "error", Code: "bad_request", Message: err.Error()})
+			continue
+		}
+
+		var resp *wsResponse
+		switch req.Op {
+		case "subscribe":
+			if address := cluster.foreignAddress(req.Addresses); address != "" {
+				resp = &wsResponse{Op: "error", ID: req.ID, Code: ErrWrongShard.Code, Message: ErrWrongShard.Error() + ": " + address}
+			} else if hub.Watch(sub, req.Addresses, maxWatchAddresses) {
+				resp = &wsResponse{Op: "result", ID: req.ID}
+			} else {
+				resp = &wsResponse{Op: "error", ID: req.ID, Code: "too_many_addresses", Message: "too many addresses"}
+			}
+		case "unsubscribe":
+			hub.Unwatch(sub, req.Addresses)
+			resp = &wsResponse{Op: "result", ID: req.ID}
+		case "set":
+			setResult, err := SetData(req.Frame)
+			if err != nil {
+				resp = wsError(req.ID, err)
+			} else {
+				resp = &wsResponse{Op: "result", ID: req.ID, Version: setResult.Version}
+			}
+		default:
+			resp = &wsResponse{Op: "error", ID: req.ID, Code: "bad_request", Message: "unknown op " + req.Op}
+		}
+		if ws.writeJSON(resp) != nil {
+			return
+		}
+	}
+}
+
+func (c *HttpServer) thWebSocketWriter(ws *wsConn, sub *Subscriber, pingInterval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-done:
+			return
+		case ev, ok := <-sub.Events:
+			if !ok {
+				ws.close(1008, "subscriber is too slow")
+				return
+			}
+			err = ws.writeJSON(&wsResponse{Op: "event", EventID: ev.ID, Entry: NewEntryView(ev.Item)})
+		case <-ticker.C:
+			err = ws.writeFrame(wsOpPing, nil)
+		}
+		if err != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+}
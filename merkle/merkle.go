@@ -0,0 +1,159 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+)
+
+// Hashing follows RFC 6962 (Certificate Transparency): leaves and inner
+// nodes are hashed with different prefixes so a leaf can not be passed
+// off as a subtree.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+	HashSize   = sha256.Size
+)
+
+var (
+	ErrIndexOutOfRange = errors.New("leaf index out of range")
+	ErrBadTreeSize     = errors.New("wrong tree size")
+)
+
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func NodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// EmptyRoot is the root of a tree without leaves.
+func EmptyRoot() []byte {
+	sum := sha256.Sum256(nil)
+	return sum[:]
+}
+
+// split returns the largest power of two smaller than n, n > 1.
+func split(n uint64) uint64 {
+	return uint64(1) << (bits.Len64(n-1) - 1)
+}
+
+// Tree is an append-only Merkle tree. It keeps the hashes of all complete
+// subtrees, so roots and proofs for any earlier size are computed with
+// O(log n) hashes.
+type Tree struct {
+	// levels[k][i] is the hash of the leaves [i<<k, (i+1)<<k).
+	levels [][][]byte
+}
+
+func NewTree() *Tree {
+	var c Tree
+	c.levels = [][][]byte{make([][]byte, 0)}
+	return &c
+}
+
+func (c *Tree) Size() uint64 {
+	return uint64(len(c.levels[0]))
+}
+
+// Append adds a leaf hash and returns its index.
+func (c *Tree) Append(leafHash []byte) uint64 {
+	index := c.Size()
+	c.levels[0] = append(c.levels[0], leafHash)
+	for k := 0; ; k++ {
+		n := len(c.levels[k])
+		if n%2 != 0 {
+			break
+		}
+		if k+1 == len(c.levels) {
+			c.levels = append(c.levels, make([][]byte, 0))
+		}
+		c.levels[k+1] = append(c.levels[k+1], NodeHash(c.levels[k][n-2], c.levels[k][n-1]))
+	}
+	return index
+}
+
+func (c *Tree) LeafHash(index uint64) []byte {
+	return c.levels[0][index]
+}
+
+// subtree returns the hash of the leaves [start, end).
+func (c *Tree) subtree(start uint64, end uint64) []byte {
+	n := end - start
+	if n&(n-1) == 0 && start%n == 0 {
+		k := bits.TrailingZeros64(n)
+		return c.levels[k][start>>k]
+	}
+	k := split(n)
+	return NodeHash(c.subtree(start, start+k), c.subtree(start+k, end))
+}
+
+// Root returns the root hash of the first size leaves.
+func (c *Tree) Root(size uint64) ([]byte, error) {
+	if size > c.Size() {
+		return nil, ErrBadTreeSize
+	}
+	if size == 0 {
+		return EmptyRoot(), nil
+	}
+	return c.subtree(0, size), nil
+}
+
+// InclusionProof returns the audit path of the leaf in the tree of the
+// first size leaves (RFC 6962, 2.1.1).
+func (c *Tree) InclusionProof(index uint64, size uint64) ([][]byte, error) {
+	if size > c.Size() {
+		return nil, ErrBadTreeSize
+	}
+	if index >= size {
+		return nil, ErrIndexOutOfRange
+	}
+	return c.path(index, 0, size), nil
+}
+
+func (c *Tree) path(m uint64, start uint64, end uint64) [][]byte {
+	n := end - start
+	if n == 1 {
+		return [][]byte{}
+	}
+	k := split(n)
+	if m < k {
+		return append(c.path(m, start, start+k), c.subtree(start+k, end))
+	}
+	return append(c.path(m-k, start+k, end), c.subtree(start, start+k))
+}
+
+// ConsistencyProof proves that the tree of the first size1 leaves is a
+// prefix of the tree of the first size2 leaves (RFC 6962, 2.1.2).
+func (c *Tree) ConsistencyProof(size1 uint64, size2 uint64) ([][]byte, error) {
+	if size2 > c.Size() || size1 > size2 {
+		return nil, ErrBadTreeSize
+	}
+	if size1 == 0 || size1 == size2 {
+		return [][]byte{}, nil
+	}
+	return c.subproof(size1, 0, size2, true), nil
+}
+
+func (c *Tree) subproof(m uint64, start uint64, end uint64, complete bool) [][]byte {
+	n := end - start
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{c.subtree(start, end)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(c.subproof(m, start, start+k, complete), c.subtree(start+k, end))
+	}
+	return append(c.subproof(m-k, start+k, end, false), c.subtree(start, start+k))
+}
@@ -0,0 +1,278 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// Test vectors of RFC 6962, as published with the Certificate
+// Transparency reference implementation.
+var testLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var testRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var testInclusionProofs = []struct {
+	index uint64
+	size  uint64
+	proof []string
+}{
+	{0, 1, nil},
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+var testConsistencyProofs = []struct {
+	size1 uint64
+	size2 uint64
+	proof []string
+}{
+	{1, 1, nil},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func fromHexList(t *testing.T, list []string) [][]byte {
+	t.Helper()
+	result := make([][]byte, 0, len(list))
+	for _, s := range list {
+		result = append(result, fromHex(t, s))
+	}
+	return result
+}
+
+func testTree(t *testing.T) *Tree {
+	t.Helper()
+	tree := NewTree()
+	for i, leaf := range testLeaves {
+		if index := tree.Append(LeafHash(fromHex(t, leaf))); index != uint64(i) {
+			t.Fatal("Append returned", index, "expected", i)
+		}
+	}
+	return tree
+}
+
+func equalProofs(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoots(t *testing.T) {
+	expected := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if root := hex.EncodeToString(EmptyRoot()); root != expected {
+		t.Fatal("empty root", root)
+	}
+	tree := testTree(t)
+	for size := uint64(0); size <= tree.Size(); size++ {
+		root, err := tree.Root(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && hex.EncodeToString(root) != testRoots[size-1] {
+			t.Fatal("root of size", size, hex.EncodeToString(root))
+		}
+	}
+	_, err := tree.Root(tree.Size() + 1)
+	if !errors.Is(err, ErrBadTreeSize) {
+		t.Fatal("expected ErrBadTreeSize, got", err)
+	}
+}
+
+func TestInclusionProof(t *testing.T) {
+	tree := testTree(t)
+	for _, v := range testInclusionProofs {
+		expected := fromHexList(t, v.proof)
+		proof, err := tree.InclusionProof(v.index, v.size)
+		if err != nil {
+			t.Fatal(v.index, v.size, err)
+		}
+		if !equalProofs(proof, expected) {
+			t.Fatal("proof of", v.index, "in", v.size, "differs from the vector")
+		}
+
+		root := fromHex(t, testRoots[v.size-1])
+		leafHash := tree.LeafHash(v.index)
+		err = VerifyInclusion(leafHash, v.index, v.size, expected, root)
+		if err != nil {
+			t.Fatal(v.index, v.size, err)
+		}
+		if len(expected) > 0 {
+			err = VerifyInclusion(leafHash, v.index, v.size, expected[1:], root)
+			if !errors.Is(err, ErrBadProof) {
+				t.Fatal(v.index, v.size, "short proof accepted")
+			}
+			err = VerifyInclusion(leafHash, v.index, v.size*2, expected, root)
+			if !errors.Is(err, ErrBadProof) {
+				t.Fatal(v.index, v.size, "wrong size accepted")
+			}
+		}
+		err = VerifyInclusion(LeafHash([]byte("other")), v.index, v.size, expected, root)
+		if !errors.Is(err, ErrBadProof) {
+			t.Fatal(v.index, v.size, "wrong leaf accepted")
+		}
+	}
+
+	_, err := tree.InclusionProof(8, 8)
+	if !errors.Is(err, ErrIndexOutOfRange) {
+		t.Fatal("expected ErrIndexOutOfRange, got", err)
+	}
+	_, err = tree.InclusionProof(0, 9)
+	if !errors.Is(err, ErrBadTreeSize) {
+		t.Fatal("expected ErrBadTreeSize, got", err)
+	}
+}
+
+// Every proof the tree builds must verify against its own roots.
+func TestInclusionProofAllSizes(t *testing.T) {
+	tree := testTree(t)
+	for size := uint64(1); size <= tree.Size(); size++ {
+		root, _ := tree.Root(size)
+		for index := uint64(0); index < size; index++ {
+			proof, err := tree.InclusionProof(index, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = VerifyInclusion(tree.LeafHash(index), index, size, proof, root)
+			if err != nil {
+				t.Fatal(index, size, err)
+			}
+		}
+	}
+}
+
+func TestConsistencyProof(t *testing.T) {
+	tree := testTree(t)
+	for _, v := range testConsistencyProofs {
+		expected := fromHexList(t, v.proof)
+		proof, err := tree.ConsistencyProof(v.size1, v.size2)
+		if err != nil {
+			t.Fatal(v.size1, v.size2, err)
+		}
+		if !equalProofs(proof, expected) {
+			t.Fatal("proof of", v.size1, "to", v.size2, "differs from the vector")
+		}
+
+		root1 := fromHex(t, testRoots[v.size1-1])
+		root2 := fromHex(t, testRoots[v.size2-1])
+		err = VerifyConsistency(v.size1, v.size2, expected, root1, root2)
+		if err != nil {
+			t.Fatal(v.size1, v.size2, err)
+		}
+		if len(expected) > 0 {
+			err = VerifyConsistency(v.size1, v.size2, expected[1:], root1, root2)
+			if !errors.Is(err, ErrBadProof) {
+				t.Fatal(v.size1, v.size2, "short proof accepted")
+			}
+			err = VerifyConsistency(v.size1, v.size2, expected, root2, root1)
+			if !errors.Is(err, ErrBadProof) {
+				t.Fatal(v.size1, v.size2, "swapped roots accepted")
+			}
+		}
+	}
+
+	_, err := tree.ConsistencyProof(5, 4)
+	if !errors.Is(err, ErrBadTreeSize) {
+		t.Fatal("expected ErrBadTreeSize, got", err)
+	}
+	err = VerifyConsistency(5, 4, nil, nil, nil)
+	if !errors.Is(err, ErrBadTreeSize) {
+		t.Fatal("expected ErrBadTreeSize, got", err)
+	}
+}
+
+func TestConsistencyProofAllSizes(t *testing.T) {
+	tree := testTree(t)
+	for size2 := uint64(1); size2 <= tree.Size(); size2++ {
+		root2, _ := tree.Root(size2)
+		for size1 := uint64(0); size1 <= size2; size1++ {
+			root1, _ := tree.Root(size1)
+			proof, err := tree.ConsistencyProof(size1, size2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = VerifyConsistency(size1, size2, proof, root1, root2)
+			if err != nil {
+				t.Fatal(size1, size2, err)
+			}
+		}
+	}
+}
+
+func TestTreeHead(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	head := TreeHead{TreeSize: 8, Timestamp: 1700000000000, RootHash: fromHex(t, testRoots[7])}
+	head.Sign(privateKey)
+	err := head.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.TreeSize = 7
+	err = head.Verify()
+	if !errors.Is(err, ErrBadSignature) {
+		t.Fatal("expected ErrBadSignature, got", err)
+	}
+}
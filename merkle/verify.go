@@ -0,0 +1,141 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrBadProof     = errors.New("merkle proof does not match the root")
+	ErrBadSignature = errors.New("tree head signature is not valid")
+)
+
+// TreeHead is a root of the log signed by the node identity key.
+type TreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`
+	RootHash  []byte `json:"root_hash"`
+	NodeID    string `json:"node_id"`
+	Signature []byte `json:"signature"`
+}
+
+// SignedData is the serialized tree head covered by the signature, like
+// the TreeHeadSignature of RFC 6962: version, signature type, timestamp
+// in milliseconds, tree size and root hash.
+func (c *TreeHead) SignedData() []byte {
+	bs := make([]byte, 2+8+8+len(c.RootHash))
+	bs[0] = 0 // v1
+	bs[1] = 1 // tree_hash
+	binary.BigEndian.PutUint64(bs[2:], uint64(c.Timestamp))
+	binary.BigEndian.PutUint64(bs[10:], c.TreeSize)
+	copy(bs[18:], c.RootHash)
+	return bs
+}
+
+func (c *TreeHead) Sign(privateKey ed25519.PrivateKey) {
+	c.NodeID = "0x" + hex.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	c.Signature = ed25519.Sign(privateKey, c.SignedData())
+}
+
+// Verify checks the signature against the key of NodeID. Callers that
+// know the key of the node should also compare it with NodeID.
+func (c *TreeHead) Verify() error {
+	publicKey, err := hex.DecodeString(strings.TrimPrefix(c.NodeID, "0x"))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize || len(c.RootHash) != HashSize {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(publicKey, c.SignedData(), c.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// VerifyInclusion checks that the leaf is at index in the tree with the
+// root (RFC 9162, 2.1.3.2).
+func VerifyInclusion(leafHash []byte, index uint64, size uint64, proof [][]byte, root []byte) error {
+	if index >= size {
+		return ErrIndexOutOfRange
+	}
+	fn := index
+	sn := size - 1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return ErrBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return ErrBadProof
+	}
+	return nil
+}
+
+// VerifyConsistency checks that the tree with root1 is a prefix of the
+// tree with root2 (RFC 9162, 2.1.4.2).
+func VerifyConsistency(size1 uint64, size2 uint64, proof [][]byte, root1 []byte, root2 []byte) error {
+	if size1 > size2 {
+		return ErrBadTreeSize
+	}
+	if size1 == size2 {
+		if len(proof) != 0 || !bytes.Equal(root1, root2) {
+			return ErrBadProof
+		}
+		return nil
+	}
+	if size1 == 0 {
+		if len(proof) != 0 {
+			return ErrBadProof
+		}
+		return nil
+	}
+	if len(proof) == 0 {
+		return ErrBadProof
+	}
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root1}, proof...)
+	}
+	fn := size1 - 1
+	sn := size2 - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return ErrBadProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, root1) || !bytes.Equal(sr, root2) {
+		return ErrBadProof
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package receipt
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrBadReceipt = errors.New("receipt is not valid")
+
+const domain = "u00-receipt-v1"
+
+// Receipt is the countersignature of a node: it accepted the frame with
+// the hash from the address at ReceivedAt. Anyone holding it can prove
+// the write to third parties without trusting the node's HTTP answer.
+type Receipt struct {
+	FrameHash  []byte    `json:"frame_hash"`
+	Address    string    `json:"address"`
+	ReceivedAt time.Time `json:"received_at"`
+	NodeID     string    `json:"node_id"`
+	Signature  []byte    `json:"signature"`
+}
+
+func FrameHash(frameBS []byte) []byte {
+	sum := sha256.Sum256(frameBS)
+	return sum[:]
+}
+
+// New signs a receipt for the frame with the node key.
+func New(privateKey ed25519.PrivateKey, frameBS []byte, address []byte, receivedAt time.Time) *Receipt {
+	var c Receipt
+	c.FrameHash = FrameHash(frameBS)
+	c.Address = "0x" + hex.EncodeToString(address)
+	c.ReceivedAt = receivedAt
+	c.NodeID = "0x" + hex.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	c.Signature = ed25519.Sign(privateKey, c.SignedData())
+	return &c
+}
+
+// SignedData is the domain tag followed by the frame hash, the address,
+// the receive time in nanoseconds and the node public key.
+func (c *Receipt) SignedData() []byte {
+	address, _ := hex.DecodeString(strings.TrimPrefix(c.Address, "0x"))
+	nodeKey, _ := hex.DecodeString(strings.TrimPrefix(c.NodeID, "0x"))
+	bs := make([]byte, 0, len(domain)+len(c.FrameHash)+len(address)+8+len(nodeKey))
+	bs = append(bs, domain...)
+	bs = append(bs, c.FrameHash...)
+	bs = append(bs, address...)
+	bs = binary.BigEndian.AppendUint64(bs, uint64(c.ReceivedAt.UnixNano()))
+	bs = append(bs, nodeKey...)
+	return bs
+}
+
+// Verify checks the signature against the key of NodeID. Callers that
+// know the key of the node should also compare it with NodeID.
+func (c *Receipt) Verify() error {
+	nodeKey, err := hex.DecodeString(strings.TrimPrefix(c.NodeID, "0x"))
+	if err != nil || len(nodeKey) != ed25519.PublicKeySize || len(c.FrameHash) != sha256.Size {
+		return ErrBadReceipt
+	}
+	address, err := hex.DecodeString(strings.TrimPrefix(c.Address, "0x"))
+	if err != nil || len(address) != ed25519.PublicKeySize {
+		return ErrBadReceipt
+	}
+	if !ed25519.Verify(nodeKey, c.SignedData(), c.Signature) {
+		return ErrBadReceipt
+	}
+	return nil
+}
+
+// VerifyFrame checks the signature and that the receipt is for the frame.
+func (c *Receipt) VerifyFrame(frameBS []byte) error {
+	err := c.Verify()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(c.FrameHash, FrameHash(frameBS)) || len(frameBS) < ed25519.PublicKeySize ||
+		c.Address != "0x"+hex.EncodeToString(frameBS[:ed25519.PublicKeySize]) {
+		return ErrBadReceipt
+	}
+	return nil
+}
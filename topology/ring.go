@@ -0,0 +1,78 @@
+package topology
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// Ring places addresses on a consistent-hash ring. Every node takes
+// VirtualNodes points on it; the owners of an address are the first
+// ReplicationFactor distinct nodes found clockwise from the hash of the
+// address, the primary first. Adding or removing a node moves only the
+// addresses next to its points.
+type Ring struct {
+	nodes             []string
+	replicationFactor int
+	points            []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func NewRing(nodes []string, virtualNodes int, replicationFactor int) *Ring {
+	var c Ring
+	c.nodes = slices.Clone(nodes)
+	slices.Sort(c.nodes)
+	c.nodes = slices.Compact(c.nodes)
+	c.replicationFactor = max(1, min(replicationFactor, len(c.nodes)))
+	for _, node := range c.nodes {
+		for i := 0; i < max(1, virtualNodes); i++ {
+			c.points = append(c.points, ringPoint{hash: ringHash([]byte(node + "#" + strconv.Itoa(i))), node: node})
+		}
+	}
+	sort.Slice(c.points, func(i, j int) bool {
+		if c.points[i].hash != c.points[j].hash {
+			return c.points[i].hash < c.points[j].hash
+		}
+		return c.points[i].node < c.points[j].node
+	})
+	return &c
+}
+
+func ringHash(bs []byte) uint64 {
+	sum := sha256.Sum256(bs)
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Nodes returns the sorted node urls of the ring.
+func (c *Ring) Nodes() []string {
+	return slices.Clone(c.nodes)
+}
+
+func (c *Ring) Owners(address []byte) []string {
+	if len(c.points) == 0 {
+		return nil
+	}
+	h := ringHash(address)
+	start := sort.Search(len(c.points), func(i int) bool {
+		return c.points[i].hash >= h
+	})
+	owners := make([]string, 0, c.replicationFactor)
+	for i := 0; i < len(c.points) && len(owners) < c.replicationFactor; i++ {
+		node := c.points[(start+i)%len(c.points)].node
+		if !slices.Contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// Equal reports whether both rings have the same nodes.
+func (c *Ring) Equal(other *Ring) bool {
+	return other != nil && slices.Equal(c.nodes, other.nodes)
+}
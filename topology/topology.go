@@ -0,0 +1,167 @@
+package topology
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// Placement schemes of a cluster.
+const (
+	PlacementShards = "shards"
+	PlacementRing   = "ring"
+)
+
+// An address belongs to the shard named by the first hex digit of its
+// public key. The replica of a shard is kept by the node of the next shard.
+const ShardCount = 16
+
+const shardDigits = "0123456789abcdef"
+
+func ShardOf(address []byte) string {
+	if len(address) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(address[:1])[:1]
+}
+
+// ShardOfHex accepts an address in hex with or without the 0x prefix.
+func ShardOfHex(address string) string {
+	address = strings.ToLower(strings.TrimPrefix(address, "0x"))
+	if len(address) == 0 || !IsShard(address[:1]) {
+		return ""
+	}
+	return address[:1]
+}
+
+func IsShard(shard string) bool {
+	return len(shard) == 1 && strings.Contains(shardDigits, shard)
+}
+
+// NextShard returns the shard whose node keeps the replica of shard.
+func NextShard(shard string) string {
+	i := strings.Index(shardDigits, shard)
+	if len(shard) != 1 || i < 0 {
+		return ""
+	}
+	return shardDigits[(i+1)%ShardCount : (i+1)%ShardCount+1]
+}
+
+// DefaultNodeUrl is the public node of the shard.
+func DefaultNodeUrl(shard string) string {
+	return "https://s" + shard + ".u00.io"
+}
+
+// Node is a server of the cluster with the shards it is the primary and
+// the replica of.
+type Node struct {
+	Url           string   `json:"url"`
+	Shards        []string `json:"shards,omitempty"`
+	ReplicaShards []string `json:"replica_shards,omitempty"`
+}
+
+type Shard struct {
+	Shard   string `json:"shard"`
+	Primary string `json:"primary"`
+	Replica string `json:"replica"`
+}
+
+// Topology is the cluster map served by /v1/topology.
+type Topology struct {
+	Placement         string  `json:"placement"`
+	ShardCount        int     `json:"shard_count,omitempty"`
+	Shards            []Shard `json:"shards,omitempty"`
+	Nodes             []Node  `json:"nodes"`
+	VirtualNodes      int     `json:"virtual_nodes,omitempty"`
+	ReplicationFactor int     `json:"replication_factor,omitempty"`
+	Epoch             int64   `json:"epoch,omitempty"`
+
+	ringOnce sync.Once
+	ring     *Ring
+}
+
+// NewRingTopology describes a cluster placed on a consistent-hash ring.
+func NewRingTopology(ring *Ring, virtualNodes int, replicationFactor int, epoch int64) *Topology {
+	var t Topology
+	t.Placement = PlacementRing
+	t.VirtualNodes = virtualNodes
+	t.ReplicationFactor = replicationFactor
+	t.Epoch = epoch
+	for _, nodeUrl := range ring.Nodes() {
+		t.Nodes = append(t.Nodes, Node{Url: nodeUrl})
+	}
+	return &t
+}
+
+// Build makes the topology from the primary node url of every shard.
+func Build(primaryUrl func(shard string) string) *Topology {
+	var t Topology
+	t.Placement = PlacementShards
+	t.ShardCount = ShardCount
+	for i := 0; i < ShardCount; i++ {
+		shard := shardDigits[i : i+1]
+		s := Shard{Shard: shard, Primary: primaryUrl(shard)}
+		if replica := primaryUrl(NextShard(shard)); replica != s.Primary {
+			s.Replica = replica
+		}
+		t.Shards = append(t.Shards, s)
+	}
+
+	nodes := make(map[string]int)
+	node := func(nodeUrl string) *Node {
+		i, exists := nodes[nodeUrl]
+		if !exists {
+			i = len(t.Nodes)
+			nodes[nodeUrl] = i
+			t.Nodes = append(t.Nodes, Node{Url: nodeUrl, Shards: make([]string, 0), ReplicaShards: make([]string, 0)})
+		}
+		return &t.Nodes[i]
+	}
+	for _, s := range t.Shards {
+		n := node(s.Primary)
+		n.Shards = append(n.Shards, s.Shard)
+	}
+	for _, s := range t.Shards {
+		if s.Replica != "" {
+			n := node(s.Replica)
+			n.ReplicaShards = append(n.ReplicaShards, s.Shard)
+		}
+	}
+	return &t
+}
+
+// Default is the topology of the public u00.io cluster.
+func Default() *Topology {
+	return Build(DefaultNodeUrl)
+}
+
+// NodesFor returns the urls of the nodes keeping the address, the primary
+// first.
+func (t *Topology) NodesFor(address []byte) []string {
+	if t.Placement == PlacementRing {
+		return t.Ring().Owners(address)
+	}
+	shard := ShardOf(address)
+	for _, s := range t.Shards {
+		if s.Shard != shard {
+			continue
+		}
+		if s.Replica == "" {
+			return []string{s.Primary}
+		}
+		return []string{s.Primary, s.Replica}
+	}
+	return nil
+}
+
+// Ring returns the hash ring of a ring topology.
+func (t *Topology) Ring() *Ring {
+	t.ringOnce.Do(func() {
+		nodes := make([]string, 0, len(t.Nodes))
+		for _, node := range t.Nodes {
+			nodes = append(nodes, node.Url)
+		}
+		t.ring = NewRing(nodes, t.VirtualNodes, t.ReplicationFactor)
+	})
+	return t.ring
+}
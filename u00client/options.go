@@ -0,0 +1,142 @@
+package u00client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/map_u00_io/topology"
+)
+
+// Options configure where the client sends its requests and how.
+type Options struct {
+	// BaseUrl sends every request to a single server, e.g. a local test
+	// server. It takes precedence over HostTemplate.
+	BaseUrl string
+
+	// HostTemplate is the url of the node of a shard; "{shard}" is
+	// replaced by the shard digit.
+	HostTemplate string
+
+	// Transport is used for all requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+
+	// Timeout limits a single attempt of a request.
+	Timeout time.Duration
+
+	// Retries is the number of extra attempts after a transport error or
+	// a 429/5xx answer. The delay before attempt n is RetryMinDelay*2^n,
+	// at most RetryMaxDelay, with random jitter of up to a half of it.
+	Retries       int
+	RetryMinDelay time.Duration
+	RetryMaxDelay time.Duration
+}
+
+func DefaultOptions() Options {
+	var c Options
+	c.HostTemplate = "https://s{shard}.u00.io"
+	c.Timeout = 1 * time.Second
+	c.Retries = 2
+	c.RetryMinDelay = 100 * time.Millisecond
+	c.RetryMaxDelay = 2 * time.Second
+	return c
+}
+
+// SetOptions replaces the options of the client. The cluster map is
+// rebuilt on the next request.
+func (c *U00Client) SetOptions(options Options) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	options.BaseUrl = strings.TrimSuffix(options.BaseUrl, "/")
+	c.options = options
+	c.httpClient = &http.Client{
+		Transport: options.Transport,
+		Timeout:   options.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	c.topology = nil
+}
+
+// defaultTopology is the cluster map used without a seed node.
+func (c *U00Client) defaultTopology() *topology.Topology {
+	c.mtx.Lock()
+	options := c.options
+	c.mtx.Unlock()
+	if options.BaseUrl != "" {
+		return topology.Build(func(shard string) string {
+			return options.BaseUrl
+		})
+	}
+	if options.HostTemplate != "" {
+		return topology.Build(func(shard string) string {
+			return strings.ReplaceAll(options.HostTemplate, "{shard}", shard)
+		})
+	}
+	return topology.Default()
+}
+
+// do sends the request and returns the body and the status of the answer.
+// Transport errors and 429/5xx answers are retried with backoff until the
+// context is done.
+func (c *U00Client) do(ctx context.Context, method string, url string, body []byte, contentType string) ([]byte, int, error) {
+	c.mtx.Lock()
+	client := c.httpClient
+	options := c.options
+	c.mtx.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		respBS, status, err := c.send(ctx, client, method, url, body, contentType)
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retry || attempt >= options.Retries || ctx.Err() != nil {
+			return respBS, status, err
+		}
+
+		delay := options.RetryMaxDelay
+		if attempt < 32 && options.RetryMinDelay<<attempt < delay {
+			delay = options.RetryMinDelay << attempt
+		}
+		if delay > 0 {
+			delay = delay/2 + rand.N(delay/2+1)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return respBS, status, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *U00Client) send(ctx context.Context, client *http.Client, method string, url string, body []byte, contentType string) ([]byte, int, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	respBS, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return respBS, resp.StatusCode, nil
+}
@@ -0,0 +1,234 @@
+package u00client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+var (
+	ErrPublisherClosed = errors.New("publisher is closed")
+	ErrQueueFull       = errors.New("publisher queue is full")
+)
+
+type PublisherConfig struct {
+	// Workers is the number of values written at the same time.
+	Workers int
+
+	// QueueSize limits the number of names with a pending value. Values of
+	// new names are dropped while the queue is full; values of pending
+	// names always replace the older value.
+	QueueSize int
+
+	// OnError, if set, is called by the workers for every failed write.
+	OnError func(name string, err error)
+}
+
+func DefaultPublisherConfig() PublisherConfig {
+	var c PublisherConfig
+	c.Workers = 4
+	c.QueueSize = 1000
+	return c
+}
+
+// PublisherStats counts the values queued for a name without a pending
+// value (Published), the ones that replaced a pending value (Coalesced)
+// and the ones lost to a full queue or to Close (Dropped).
+type PublisherStats struct {
+	Published int64  `json:"published"`
+	Coalesced int64  `json:"coalesced"`
+	Dropped   int64  `json:"dropped"`
+	Sent      int64  `json:"sent"`
+	Failed    int64  `json:"failed"`
+	Pending   int    `json:"pending"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type pendingValue struct {
+	value string
+	dt    time.Time
+}
+
+// Publisher writes values in the background. Only the newest pending
+// value of a name is written and a name is never written by two workers
+// at once, so the values of a name are stored in order.
+type Publisher struct {
+	mtx     sync.Mutex
+	cond    *sync.Cond
+	client  *U00Client
+	config  PublisherConfig
+	pending map[string]*pendingValue
+	queue   []string
+	sending map[string]bool
+	stamps  map[string]time.Time
+	closed  bool
+	stats   PublisherStats
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewPublisher(client *U00Client, config PublisherConfig) *Publisher {
+	var c Publisher
+	c.cond = sync.NewCond(&c.mtx)
+	c.client = client
+	c.config = config
+	c.config.Workers = max(1, c.config.Workers)
+	c.config.QueueSize = max(1, c.config.QueueSize)
+	c.pending = make(map[string]*pendingValue)
+	c.sending = make(map[string]bool)
+	c.stamps = make(map[string]time.Time)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	for i := 0; i < c.config.Workers; i++ {
+		c.wg.Add(1)
+		go c.thWorker()
+	}
+	return &c
+}
+
+// Publish queues the value and returns at once. The value is stamped
+// with the current time, after the previous value of the name, so a later
+// value always wins.
+func (c *Publisher) Publish(name string, value string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return ErrPublisherClosed
+	}
+	if p, exists := c.pending[name]; exists {
+		p.value = value
+		p.dt = c.stamp(name)
+		c.stats.Coalesced++
+		return nil
+	}
+	if len(c.pending) >= c.config.QueueSize {
+		c.stats.Dropped++
+		return ErrQueueFull
+	}
+	c.pending[name] = &pendingValue{value: value, dt: c.stamp(name)}
+	c.stats.Published++
+	if !c.sending[name] {
+		c.queue = append(c.queue, name)
+		c.cond.Signal()
+	}
+	return nil
+}
+
+// stamp returns the time of a new value of the name. Times are kept in
+// milliseconds, the resolution of v1 frames, and a value stamped within
+// the millisecond of the previous one gets the next millisecond, as the
+// server refuses times that are not newer than the stored one.
+func (c *Publisher) stamp(name string) time.Time {
+	now := time.Now().Truncate(time.Millisecond)
+	dt := now
+	if last, exists := c.stamps[name]; exists && !dt.After(last) {
+		dt = last.Add(time.Millisecond)
+	}
+	if len(c.stamps) >= c.config.QueueSize {
+		// Names stamped before this millisecond need no correction.
+		for key, last := range c.stamps {
+			if last.Before(now) {
+				delete(c.stamps, key)
+			}
+		}
+	}
+	c.stamps[name] = dt
+	return dt
+}
+
+func (c *Publisher) thWorker() {
+	defer c.wg.Done()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for {
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return
+		}
+		name := c.queue[0]
+		c.queue = c.queue[1:]
+		p := c.pending[name]
+		delete(c.pending, name)
+		c.sending[name] = true
+
+		c.mtx.Unlock()
+		_, err := c.client.WriteValueContext(c.ctx, name, p.dt, p.value)
+		if err != nil {
+			logger.Println("U00Client Publisher", name, "error:", err)
+			if c.config.OnError != nil {
+				c.config.OnError(name, err)
+			}
+		}
+		c.mtx.Lock()
+
+		delete(c.sending, name)
+		if err != nil {
+			c.stats.Failed++
+			c.stats.LastError = err.Error()
+		} else {
+			c.stats.Sent++
+		}
+		if _, exists := c.pending[name]; exists {
+			c.queue = append(c.queue, name)
+		}
+		c.cond.Broadcast()
+	}
+}
+
+// Flush waits until every published value has been written or has
+// failed.
+func (c *Publisher) Flush(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.mtx.Lock()
+		c.cond.Broadcast()
+		c.mtx.Unlock()
+	})
+	defer stop()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for len(c.pending) > 0 || len(c.sending) > 0 {
+		if c.closed {
+			return ErrPublisherClosed
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.cond.Wait()
+	}
+	return nil
+}
+
+// Close stops the workers. Writes in progress are cancelled and values
+// still pending are dropped; call Flush first for a clean shutdown.
+func (c *Publisher) Close() error {
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return ErrPublisherClosed
+	}
+	c.closed = true
+	c.stats.Dropped += int64(len(c.pending))
+	c.pending = make(map[string]*pendingValue)
+	c.queue = nil
+	c.cond.Broadcast()
+	c.mtx.Unlock()
+
+	c.cancel()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Publisher) Stats() PublisherStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	stats := c.stats
+	stats.Pending = len(c.pending)
+	return stats
+}
@@ -0,0 +1,29 @@
+package u00client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublisherStamp(t *testing.T) {
+	config := DefaultPublisherConfig()
+	config.QueueSize = 2
+	c := NewPublisher(nil, config)
+	defer c.Close()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	last := make(map[string]time.Time)
+	for i := 0; i < 1000; i++ {
+		for _, name := range []string{"a", "b", "c"} {
+			dt := c.stamp(name)
+			if !dt.Equal(dt.Truncate(time.Millisecond)) {
+				t.Fatal("time is not in milliseconds:", dt)
+			}
+			if prev, exists := last[name]; exists && !dt.After(prev) {
+				t.Fatal(name, "stamped", dt, "after", prev)
+			}
+			last[name] = dt
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package u00client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ipoluianov/gomisc/logger"
+)
+
+// QuorumRead is the result of ReadQuorum. Answered lists the nodes that
+// replied, Repaired the ones the newest frame was written back to.
+type QuorumRead struct {
+	Record   *Record
+	Answered []string
+	Failed   []string
+	Repaired []string
+}
+
+type nodeRead struct {
+	nodeUrl string
+	record  *Record
+	err     error
+}
+
+// NewerThan orders records by the signed timestamp and then by the
+// sequence number of v2 frames, as the servers do.
+func (c *Record) NewerThan(other *Record) bool {
+	if !c.Time.Equal(other.Time) {
+		return c.Time.After(other.Time)
+	}
+	return c.Seq > other.Seq
+}
+
+// ReadQuorum reads the value from every node of the address in parallel
+// and returns the one with the newest signed timestamp. Nodes that
+// returned an older value, none or a frame that does not verify get the
+// newest frame written back. If the newest frame is a tombstone it is
+// written back the same way and the read fails with ErrNotFound.
+func (c *U00Client) ReadQuorum(address string, name string) (*QuorumRead, error) {
+	return c.ReadQuorumContext(context.Background(), address, name)
+}
+
+func (c *U00Client) ReadQuorumContext(ctx context.Context, address string, name string) (*QuorumRead, error) {
+	addressBS, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	if err != nil || len(addressBS) != ed25519.PublicKeySize {
+		return nil, errors.New("wrong address: " + address)
+	}
+
+	nodes := c.TopologyContext(ctx).NodesFor(addressBS)
+	reads := make([]nodeRead, len(nodes))
+	var wg sync.WaitGroup
+	for i, nodeUrl := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record, err := c.readFromNode(ctx, nodeUrl, addressBS, name)
+			reads[i] = nodeRead{nodeUrl: nodeUrl, record: record, err: err}
+		}()
+	}
+	wg.Wait()
+
+	var result QuorumRead
+	var notFound, badSignature bool
+	var lastErr error
+	for _, read := range reads {
+		switch {
+		case read.err == nil:
+			if result.Record == nil || read.record.NewerThan(result.Record) {
+				result.Record = read.record
+			}
+		case errors.Is(read.err, ErrNotFound):
+			notFound = true
+		case errors.Is(read.err, ErrBadSignature):
+			badSignature = true
+		default:
+			logger.Println("U00Client ReadQuorum", read.nodeUrl, "error:", read.err)
+			result.Failed = append(result.Failed, read.nodeUrl)
+			lastErr = read.err
+			continue
+		}
+		result.Answered = append(result.Answered, read.nodeUrl)
+	}
+
+	if result.Record == nil {
+		switch {
+		case badSignature:
+			return &result, ErrBadSignature
+		case notFound:
+			return &result, ErrNotFound
+		case lastErr != nil:
+			return &result, lastErr
+		}
+		return &result, fmt.Errorf("%w: %w", ErrTransport, errNoNode)
+	}
+
+	for _, read := range reads {
+		stale := read.err != nil && !errors.Is(read.err, ErrTransport)
+		if read.err == nil && result.Record.NewerThan(read.record) {
+			stale = true
+		}
+		if !stale {
+			continue
+		}
+		_, err := c.writeValueToServer(ctx, read.nodeUrl+"/set", result.Record.Frame)
+		if err != nil {
+			logger.Println("U00Client ReadQuorum repair of", read.nodeUrl, "error:", err)
+			continue
+		}
+		result.Repaired = append(result.Repaired, read.nodeUrl)
+	}
+	if result.Record.Deleted {
+		result.Record = nil
+		return &result, ErrNotFound
+	}
+	return &result, nil
+}
@@ -0,0 +1,147 @@
+package u00client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+)
+
+var (
+	ErrNotFound     = errors.New("value not found")
+	ErrBadSignature = errors.New("frame is not signed by the address")
+	ErrTransport    = errors.New("transport error")
+)
+
+// Record is a value read from the servers after its frame was verified
+// against the requested address.
+type Record struct {
+	Address     string
+	Name        string
+	Value       []byte
+	Time        time.Time
+	Seq         uint64
+	ContentType byte
+	Frame       []byte
+
+	// Deleted marks a signed tombstone; Value is empty.
+	Deleted bool
+}
+
+// ReadValue reads the most recently written value of the address.
+func (c *U00Client) ReadValue(address string) (*Record, error) {
+	return c.ReadNamedValueContext(context.Background(), address, "")
+}
+
+func (c *U00Client) ReadValueContext(ctx context.Context, address string) (*Record, error) {
+	return c.ReadNamedValueContext(ctx, address, "")
+}
+
+// ReadNamedValue reads the named value of the address from its primary
+// node, falling back to the replica if the node is down or has no entry.
+// A tombstone ends the search. It fails with ErrNotFound if no node
+// has the value, ErrBadSignature if the nodes returned only frames that
+// do not verify and ErrTransport if no node answered.
+func (c *U00Client) ReadNamedValue(address string, name string) (*Record, error) {
+	return c.ReadNamedValueContext(context.Background(), address, name)
+}
+
+func (c *U00Client) ReadNamedValueContext(ctx context.Context, address string, name string) (*Record, error) {
+	addressBS, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	if err != nil || len(addressBS) != ed25519.PublicKeySize {
+		return nil, errors.New("wrong address: " + address)
+	}
+
+	nodes := c.TopologyContext(ctx).NodesFor(addressBS)
+	var notFound, badSignature bool
+	var lastErr error
+	for i := 0; i < len(nodes); i++ {
+		record, err := c.readFromNode(ctx, nodes[i], addressBS, name)
+		if err == nil && record.Deleted {
+			return nil, ErrNotFound
+		}
+		if err == nil {
+			return record, nil
+		}
+		logger.Println("U00Client ReadValue", nodes[i], "error:", err)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			notFound = true
+		case errors.Is(err, ErrBadSignature):
+			badSignature = true
+		default:
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if i == 0 && needsRefresh(err) {
+				nodes = c.refreshTopology(ctx).NodesFor(addressBS)
+			}
+		}
+	}
+	switch {
+	case badSignature:
+		return nil, ErrBadSignature
+	case notFound:
+		return nil, ErrNotFound
+	case lastErr != nil:
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("%w: %w", ErrTransport, errNoNode)
+}
+
+func (c *U00Client) readFromNode(ctx context.Context, nodeUrl string, address []byte, name string) (*Record, error) {
+	bs, status, err := c.do(ctx, http.MethodGet, nodeUrl+"/v1/entry/0x"+hex.EncodeToString(address)+"/"+name, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTransport, err)
+	}
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return nil, ErrNotFound
+	}
+	if status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect || status == http.StatusMisdirectedRequest {
+		return nil, fmt.Errorf("%w: %w", ErrTransport, errMoved)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: server returned status %s", ErrTransport, http.StatusText(status))
+	}
+
+	var view struct {
+		Frame []byte `json:"frame"`
+	}
+	err = json.Unmarshal(bs, &view)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTransport, err)
+	}
+	return decodeRecord(view.Frame, address, name)
+}
+
+// decodeRecord verifies that the frame is signed by the address and holds
+// the requested name, so a node can not pass off another entry.
+func decodeRecord(frameBS []byte, address []byte, name string) (*Record, error) {
+	f, err := frame.Verify(frameBS)
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	if !bytes.Equal(f.Address, address) || (name != "" && f.Name != name) {
+		return nil, ErrBadSignature
+	}
+	return &Record{
+		Address:     f.AddressHex(),
+		Name:        f.Name,
+		Value:       f.Value,
+		Time:        f.Time,
+		Seq:         f.Seq,
+		ContentType: f.ContentType,
+		Frame:       frameBS,
+		Deleted:     f.Delete,
+	}, nil
+}
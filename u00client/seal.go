@@ -0,0 +1,274 @@
+package u00client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/receipt"
+)
+
+var (
+	ErrNotEncrypted  = errors.New("value is not encrypted")
+	ErrNotRecipient  = errors.New("value is not sealed for this key")
+	ErrBadCiphertext = errors.New("sealed value is malformed")
+	ErrBadPublicKey  = errors.New("public key can not be converted to X25519")
+)
+
+// A sealed value is
+//
+//	[version 1][ephemeral X25519 key 32][n 1][n wrapped keys 48][nonce 12][ciphertext]
+//
+// The value is encrypted with a random AES-256-GCM content key. For every
+// recipient the content key is wrapped with a key derived from the X25519
+// secret of the ephemeral key and the recipient's key, which is converted
+// from its ed25519 address. The address of the writer is the additional
+// data of the content, so the ciphertext can not be re-signed by another
+// key. Recipients are not listed; readers try every wrapped key.
+const (
+	sealVersion       = 1
+	sealKeySize       = 32
+	sealWrappedSize   = sealKeySize + 16
+	sealNonceSize     = 12
+	sealMaxRecipients = 32
+	sealInfo          = "u00-seal-v1"
+)
+
+// WriteEncrypted seals the value for the recipient addresses and the
+// writer itself and writes it as a v2 frame with the encrypted content
+// type.
+func (c *U00Client) WriteEncrypted(name string, dt time.Time, value []byte, recipients ...string) ([]*receipt.Receipt, error) {
+	return c.WriteEncryptedContext(context.Background(), name, dt, value, recipients...)
+}
+
+func (c *U00Client) WriteEncryptedContext(ctx context.Context, name string, dt time.Time, value []byte, recipients ...string) ([]*receipt.Receipt, error) {
+	if len(c.privateKey) != 64 || len(c.publicKey) != 32 {
+		return nil, errors.New("private key is not set or public key is empty")
+	}
+	keys := [][]byte{c.publicKey}
+	for _, address := range recipients {
+		key, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("wrong recipient address: " + address)
+		}
+		if !slices.ContainsFunc(keys, func(k []byte) bool { return bytes.Equal(k, key) }) {
+			keys = append(keys, key)
+		}
+	}
+	sealed, err := seal(value, c.publicKey, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	f := frame.Frame{
+		Version:     frame.Version2,
+		Name:        name,
+		Value:       sealed,
+		Time:        dt,
+		Seq:         c.seq.Add(1),
+		ContentType: frame.ContentTypeEncrypted,
+	}
+	frameBS, err := frame.Encode(c.privateKey, &f)
+	if err != nil {
+		return nil, err
+	}
+	return c.writeFrame(ctx, frameBS)
+}
+
+// ReadDecrypted reads the named value of the address, checks the frame
+// signature and opens the value with the client's key.
+func (c *U00Client) ReadDecrypted(address string, name string) ([]byte, error) {
+	return c.ReadDecryptedContext(context.Background(), address, name)
+}
+
+func (c *U00Client) ReadDecryptedContext(ctx context.Context, address string, name string) ([]byte, error) {
+	if len(c.privateKey) != 64 {
+		return nil, errors.New("private key is not set")
+	}
+	record, err := c.ReadNamedValueContext(ctx, address, name)
+	if err != nil {
+		return nil, err
+	}
+	if record.ContentType != frame.ContentTypeEncrypted {
+		return nil, ErrNotEncrypted
+	}
+	return open(record.Value, record.Frame[:frame.AddressSize], c.privateKey)
+}
+
+func seal(value []byte, writer []byte, recipients [][]byte) ([]byte, error) {
+	if len(recipients) > sealMaxRecipients {
+		return nil, errors.New("too many recipients")
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	contentKey := make([]byte, sealKeySize)
+	_, err = rand.Read(contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []byte{sealVersion}
+	out = append(out, ephemeral.PublicKey().Bytes()...)
+	out = append(out, byte(len(recipients)))
+	for _, recipient := range recipients {
+		wrapped, err := wrapKey(ephemeral, recipient, contentKey)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, wrapped...)
+	}
+
+	nonce := make([]byte, sealNonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, value, writer), nil
+}
+
+func open(sealed []byte, writer []byte, privateKey ed25519.PrivateKey) ([]byte, error) {
+	if len(sealed) < 2+sealKeySize || sealed[0] != sealVersion {
+		return nil, ErrBadCiphertext
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[1 : 1+sealKeySize])
+	if err != nil {
+		return nil, ErrBadCiphertext
+	}
+	n := int(sealed[1+sealKeySize])
+	offset := 2 + sealKeySize
+	if len(sealed) < offset+n*sealWrappedSize+sealNonceSize {
+		return nil, ErrBadCiphertext
+	}
+	own, err := x25519PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := own.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrBadCiphertext
+	}
+	kek, err := keyEncryptionKey(secret, ephemeral, own.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	var contentKey []byte
+	for i := 0; i < n && contentKey == nil; i++ {
+		wrapped := sealed[offset+i*sealWrappedSize : offset+(i+1)*sealWrappedSize]
+		contentKey, _ = kek.Open(nil, make([]byte, sealNonceSize), wrapped, nil)
+	}
+	if contentKey == nil {
+		return nil, ErrNotRecipient
+	}
+	offset += n * sealWrappedSize
+	aead, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	value, err := aead.Open(nil, sealed[offset:offset+sealNonceSize], sealed[offset+sealNonceSize:], writer)
+	if err != nil {
+		return nil, ErrBadCiphertext
+	}
+	return value, nil
+}
+
+// wrapKey encrypts the content key for one recipient. Every wrapping key
+// is used once, as the ephemeral key is new for each value, so a zero
+// nonce is safe.
+func wrapKey(ephemeral *ecdh.PrivateKey, recipient []byte, contentKey []byte) ([]byte, error) {
+	recipientKey, err := x25519PublicKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := keyEncryptionKey(secret, ephemeral.PublicKey(), recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	return kek.Seal(nil, make([]byte, sealNonceSize), contentKey, nil), nil
+}
+
+// keyEncryptionKey derives the wrapping key of the recipient from the
+// X25519 secret, bound to the ephemeral and the recipient keys.
+func keyEncryptionKey(secret []byte, ephemeral *ecdh.PublicKey, recipient *ecdh.PublicKey) (cipher.AEAD, error) {
+	salt := append(slices.Clone(ephemeral.Bytes()), recipient.Bytes()...)
+	return newGCM(deriveKey(secret, salt, []byte(sealInfo)))
+}
+
+// deriveKey is HKDF-SHA256 (RFC 5869) with a single output block.
+func deriveKey(secret []byte, salt []byte, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519PrivateKey converts an ed25519 private key the same way as
+// libsodium: the scalar is the first half of SHA-512 of the seed.
+func x25519PrivateKey(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(privateKey.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+var curve25519P, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// x25519PublicKey maps an ed25519 public key to the Montgomery form:
+// u = (1 + y) / (1 - y) mod p.
+func x25519PublicKey(publicKey []byte) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, ErrBadPublicKey
+	}
+	le := slices.Clone(publicKey)
+	le[31] &= 0x7f
+	slices.Reverse(le)
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, ErrBadPublicKey
+	}
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, ErrBadPublicKey
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+	bs := u.FillBytes(make([]byte, 32))
+	slices.Reverse(bs)
+	return ecdh.X25519().NewPublicKey(bs)
+}
@@ -0,0 +1,186 @@
+package u00client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func testKeys(t *testing.T, n int) []ed25519.PrivateKey {
+	t.Helper()
+	keys := make([]ed25519.PrivateKey, 0, n)
+	for i := 0; i < n; i++ {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, privateKey)
+	}
+	return keys
+}
+
+func publicKeyOf(privateKey ed25519.PrivateKey) []byte {
+	return privateKey.Public().(ed25519.PublicKey)
+}
+
+func TestX25519Conversion(t *testing.T) {
+	keys := testKeys(t, 16)
+	for _, privateKey := range keys {
+		own, err := x25519PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, err := x25519PublicKey(publicKeyOf(privateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(own.PublicKey().Bytes(), converted.Bytes()) {
+			t.Fatal("converted public key differs from the public key of the converted private key")
+		}
+	}
+
+	a, _ := x25519PrivateKey(keys[0])
+	b, _ := x25519PrivateKey(keys[1])
+	aPublic, _ := x25519PublicKey(publicKeyOf(keys[0]))
+	bPublic, _ := x25519PublicKey(publicKeyOf(keys[1]))
+	secret1, err := a.ECDH(bPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret2, err := b.ECDH(aPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret1, secret2) {
+		t.Fatal("shared secrets differ")
+	}
+}
+
+func TestX25519ConversionBadKeys(t *testing.T) {
+	// y = 1 is the identity point, it has no Montgomery form.
+	identity := make([]byte, ed25519.PublicKeySize)
+	identity[0] = 1
+	// y = p is not reduced.
+	unreduced, _ := hex.DecodeString("edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f")
+	for _, key := range [][]byte{identity, unreduced, make([]byte, 31)} {
+		_, err := x25519PublicKey(key)
+		if !errors.Is(err, ErrBadPublicKey) {
+			t.Fatal(hex.EncodeToString(key), "expected ErrBadPublicKey, got", err)
+		}
+	}
+}
+
+// RFC 5869, test case 1; deriveKey returns the first block of the OKM.
+func TestDeriveKey(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x0b}, 22)
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf"
+	if key := hex.EncodeToString(deriveKey(secret, salt, info)); key != expected {
+		t.Fatal("unexpected key", key)
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	keys := testKeys(t, 4)
+	writer := publicKeyOf(keys[0])
+	value := []byte("secret value")
+	sealed, err := seal(value, writer, [][]byte{writer, publicKeyOf(keys[1]), publicKeyOf(keys[2])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, value) {
+		t.Fatal("the value is not encrypted")
+	}
+	for _, privateKey := range keys[:3] {
+		opened, err := open(sealed, writer, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, value) {
+			t.Fatal("unexpected value", string(opened))
+		}
+	}
+
+	_, err = open(sealed, writer, keys[3])
+	if !errors.Is(err, ErrNotRecipient) {
+		t.Fatal("expected ErrNotRecipient, got", err)
+	}
+
+	// The content is bound to the address of the writer.
+	_, err = open(sealed, publicKeyOf(keys[3]), keys[1])
+	if !errors.Is(err, ErrBadCiphertext) {
+		t.Fatal("other writer: expected ErrBadCiphertext, got", err)
+	}
+
+	again, err := seal(value, writer, [][]byte{writer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again[:1+sealKeySize], sealed[:1+sealKeySize]) {
+		t.Fatal("the ephemeral key is reused")
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	keys := testKeys(t, 1)
+	writer := publicKeyOf(keys[0])
+	sealed, err := seal([]byte("secret value"), writer, [][]byte{writer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err = open(tampered, writer, keys[0])
+	if !errors.Is(err, ErrBadCiphertext) {
+		t.Fatal("ciphertext: expected ErrBadCiphertext, got", err)
+	}
+
+	// A changed wrapped key is not recognized as ours.
+	tampered = bytes.Clone(sealed)
+	tampered[2+sealKeySize] ^= 0x01
+	_, err = open(tampered, writer, keys[0])
+	if !errors.Is(err, ErrNotRecipient) {
+		t.Fatal("wrapped key: expected ErrNotRecipient, got", err)
+	}
+
+	tampered = bytes.Clone(sealed)
+	tampered[0] = sealVersion + 1
+	_, err = open(tampered, writer, keys[0])
+	if !errors.Is(err, ErrBadCiphertext) {
+		t.Fatal("version: expected ErrBadCiphertext, got", err)
+	}
+
+	// The recipient count claims more wrapped keys than there are.
+	tampered = bytes.Clone(sealed)
+	tampered[1+sealKeySize] = 200
+	_, err = open(tampered, writer, keys[0])
+	if !errors.Is(err, ErrBadCiphertext) {
+		t.Fatal("count: expected ErrBadCiphertext, got", err)
+	}
+
+	_, err = open(sealed[:2+sealKeySize+sealWrappedSize], writer, keys[0])
+	if !errors.Is(err, ErrBadCiphertext) {
+		t.Fatal("truncated: expected ErrBadCiphertext, got", err)
+	}
+}
+
+func TestSealTooManyRecipients(t *testing.T) {
+	keys := testKeys(t, sealMaxRecipients+1)
+	recipients := make([][]byte, 0, len(keys))
+	for _, privateKey := range keys {
+		recipients = append(recipients, publicKeyOf(privateKey))
+	}
+	_, err := seal([]byte("v"), recipients[0], recipients)
+	if err == nil {
+		t.Fatal("too many recipients accepted")
+	}
+	_, err = seal([]byte("v"), recipients[0], recipients[:sealMaxRecipients])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package u00client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/topology"
+)
+
+const topologyTTL = 5 * time.Minute
+
+// errMoved is returned for a node that redirects the request: the
+// address is served by another node now.
+var errMoved = errors.New("address moved to another node")
+
+// SetSeed makes the client discover the cluster through the node at
+// seedUrl instead of using the nodes of the options.
+func (c *U00Client) SetSeed(seedUrl string) {
+	c.mtx.Lock()
+	c.seedUrl = strings.TrimSuffix(seedUrl, "/")
+	c.topology = nil
+	c.mtx.Unlock()
+}
+
+// Topology returns the cached cluster map, loading it if it is missing
+// or outdated.
+func (c *U00Client) Topology() *topology.Topology {
+	return c.TopologyContext(context.Background())
+}
+
+func (c *U00Client) TopologyContext(ctx context.Context) *topology.Topology {
+	c.mtx.Lock()
+	t := c.topology
+	fresh := t != nil && time.Since(c.topologyTime) < topologyTTL
+	c.mtx.Unlock()
+	if fresh {
+		return t
+	}
+	return c.refreshTopology(ctx)
+}
+
+// refreshTopology loads the cluster map from the seed or, if the seed is
+// down, from any known node. The old map is kept if nobody answers.
+func (c *U00Client) refreshTopology(ctx context.Context) *topology.Topology {
+	c.mtx.Lock()
+	seedUrl := c.seedUrl
+	old := c.topology
+	c.mtx.Unlock()
+
+	if seedUrl == "" {
+		t := c.defaultTopology()
+		c.setTopology(t)
+		return t
+	}
+
+	urls := []string{seedUrl}
+	if old != nil {
+		for _, node := range old.Nodes {
+			if node.Url != seedUrl {
+				urls = append(urls, node.Url)
+			}
+		}
+	}
+	for _, nodeUrl := range urls {
+		t, err := c.loadTopology(ctx, nodeUrl)
+		if err != nil {
+			logger.Println("U00Client loading topology from", nodeUrl, "error:", err)
+			continue
+		}
+		c.setTopology(t)
+		return t
+	}
+	if old != nil {
+		return old
+	}
+	return c.defaultTopology()
+}
+
+func (c *U00Client) setTopology(t *topology.Topology) {
+	c.mtx.Lock()
+	c.topology = t
+	c.topologyTime = time.Now()
+	c.mtx.Unlock()
+}
+
+func (c *U00Client) loadTopology(ctx context.Context, nodeUrl string) (*topology.Topology, error) {
+	var t topology.Topology
+	err := c.getJSON(ctx, nodeUrl+"/v1/topology", &t)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Nodes) == 0 {
+		return nil, errors.New("empty topology")
+	}
+	return &t, nil
+}
+
+func (c *U00Client) getJSON(ctx context.Context, url string, v any) error {
+	bs, status, err := c.do(ctx, http.MethodGet, url, nil, "")
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return errors.New("server returned status " + http.StatusText(status) + ": " + string(bs))
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// needsRefresh reports whether the error means the topology is outdated:
+// the node redirected the request or could not be reached.
+func needsRefresh(err error) bool {
+	var urlErr *url.Error
+	return errors.Is(err, errMoved) || errors.As(err, &urlErr)
+}
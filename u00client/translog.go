@@ -0,0 +1,113 @@
+package u00client
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipoluianov/map_u00_io/merkle"
+)
+
+type inclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+type consistencyProof struct {
+	First       uint64   `json:"first"`
+	Second      uint64   `json:"second"`
+	Consistency [][]byte `json:"consistency"`
+}
+
+// TreeHead returns the signed tree head of the node's transparency log
+// after checking its signature.
+func (c *U00Client) TreeHead(nodeUrl string) (*merkle.TreeHead, error) {
+	return c.TreeHeadContext(context.Background(), nodeUrl)
+}
+
+func (c *U00Client) TreeHeadContext(ctx context.Context, nodeUrl string) (*merkle.TreeHead, error) {
+	var head merkle.TreeHead
+	err := c.getJSON(ctx, nodeUrl+"/v1/log/sth", &head)
+	if err != nil {
+		return nil, err
+	}
+	err = head.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+// VerifyInclusion proves that the leaf is in the node's log and returns
+// the signed tree head the proof was checked against.
+func (c *U00Client) VerifyInclusion(nodeUrl string, leafHash []byte) (*merkle.TreeHead, error) {
+	return c.VerifyInclusionContext(context.Background(), nodeUrl, leafHash)
+}
+
+func (c *U00Client) VerifyInclusionContext(ctx context.Context, nodeUrl string, leafHash []byte) (*merkle.TreeHead, error) {
+	head, err := c.TreeHeadContext(ctx, nodeUrl)
+	if err != nil {
+		return nil, err
+	}
+	var proof inclusionProof
+	url := fmt.Sprintf("%s/v1/log/inclusion?hash=0x%s&tree_size=%d", nodeUrl, hex.EncodeToString(leafHash), head.TreeSize)
+	err = c.getJSON(ctx, url, &proof)
+	if err != nil {
+		return nil, err
+	}
+	err = merkle.VerifyInclusion(leafHash, proof.LeafIndex, head.TreeSize, proof.AuditPath, head.RootHash)
+	if err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// VerifyConsistency proves that the log of the node only grew between
+// two tree heads, i.e. nothing was dropped or reordered.
+func (c *U00Client) VerifyConsistency(nodeUrl string, older *merkle.TreeHead, newer *merkle.TreeHead) error {
+	return c.VerifyConsistencyContext(context.Background(), nodeUrl, older, newer)
+}
+
+func (c *U00Client) VerifyConsistencyContext(ctx context.Context, nodeUrl string, older *merkle.TreeHead, newer *merkle.TreeHead) error {
+	if older.NodeID != newer.NodeID {
+		return errors.New("tree heads of different nodes")
+	}
+	if err := older.Verify(); err != nil {
+		return err
+	}
+	if err := newer.Verify(); err != nil {
+		return err
+	}
+	var proof consistencyProof
+	url := fmt.Sprintf("%s/v1/log/consistency?first=%d&second=%d", nodeUrl, older.TreeSize, newer.TreeSize)
+	err := c.getJSON(ctx, url, &proof)
+	if err != nil {
+		return err
+	}
+	return merkle.VerifyConsistency(older.TreeSize, newer.TreeSize, proof.Consistency, older.RootHash, newer.RootHash)
+}
+
+// WriteAndProve writes the value to the primary node, proves that the
+// node logged the frame and returns the tree head of the proof. The
+// replicas are written as usual.
+func (c *U00Client) WriteAndProve(name string, value string) (*merkle.TreeHead, error) {
+	return c.WriteAndProveContext(context.Background(), name, value)
+}
+
+func (c *U00Client) WriteAndProveContext(ctx context.Context, name string, value string) (*merkle.TreeHead, error) {
+	frameBS, err := c.encodeValue(name, time.Now(), value, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.writeToNode(ctx, 0, frameBS)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(c.serverUrls(ctx)); i++ {
+		c.writeToNode(ctx, i, frameBS)
+	}
+	return c.VerifyInclusionContext(ctx, c.serverUrls(ctx)[0], merkle.LeafHash(frameBS))
+}
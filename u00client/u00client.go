@@ -1,31 +1,60 @@
 package u00client
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/ed25519"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ipoluianov/gomisc/logger"
+	"github.com/ipoluianov/map_u00_io/frame"
+	"github.com/ipoluianov/map_u00_io/receipt"
+	"github.com/ipoluianov/map_u00_io/topology"
 	"github.com/ipoluianov/map_u00_io/utils"
 )
 
+var (
+	ErrVersionConflict = errors.New("version conflict")
+	errNoNode          = errors.New("no node for the address")
+)
+
+type SetResult struct {
+	Version  uint64           `json:"version"`
+	LogIndex uint64           `json:"log_index"`
+	LeafHash []byte           `json:"leaf_hash"`
+	Receipt  *receipt.Receipt `json:"receipt"`
+}
+
 type U00Client struct {
-	privateKey []byte
-	publicKey  []byte
+	privateKey   []byte
+	publicKey    []byte
+	frameVersion int
+	seq          atomic.Uint64
+
+	mtx          sync.Mutex
+	options      Options
+	httpClient   *http.Client
+	seedUrl      string
+	topology     *topology.Topology
+	topologyTime time.Time
 }
 
 func NewClientWithKey(privateKey []byte) *U00Client {
+	return NewClientWithOptions(privateKey, DefaultOptions())
+}
+
+func NewClientWithOptions(privateKey []byte, options Options) *U00Client {
 	var c U00Client
 	c.privateKey = privateKey
 	if len(privateKey) >= 64 {
 		c.publicKey = privateKey[32:64]
 	}
+	c.SetOptions(options)
 	return &c
 }
 
@@ -34,6 +63,12 @@ func NewClient() *U00Client {
 	return NewClientWithKey(privateKey)
 }
 
+// SetFrameVersion selects the payload format of written frames:
+// frame.Version1 (zip, default) or frame.Version2 (binary).
+func (c *U00Client) SetFrameVersion(version int) {
+	c.frameVersion = version
+}
+
 func (c *U00Client) Address() string {
 	if len(c.publicKey) != 32 {
 		return ""
@@ -41,128 +76,206 @@ func (c *U00Client) Address() string {
 	return "0x" + hex.EncodeToString(c.publicKey)
 }
 
-func (c *U00Client) sendPostBytes(url string, data []byte, contentType string) ([]byte, int, error) {
-	client := &http.Client{
-		Timeout: 1 * time.Second,
+func (c *U00Client) writeValueToServer(ctx context.Context, url string, data []byte) (*SetResult, error) {
+	respBS, status, err := c.do(ctx, http.MethodPost, url, data, "application/octet-stream")
+	if err != nil {
+		logger.Println("U00Client WriteValue error:", err, respBS, status)
+		return nil, err
 	}
-
-	resp, err := client.Post(url, contentType, bytes.NewReader(data))
+	if status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect || status == http.StatusMisdirectedRequest {
+		logger.Println("U00Client WriteValue:", url, "moved")
+		return nil, errMoved
+	}
+	if status == http.StatusConflict && strings.Contains(string(respBS), "version_conflict") {
+		return nil, ErrVersionConflict
+	}
+	if status != http.StatusOK {
+		logger.Println("U00Client WriteValue error: status", status, "response:", string(respBS))
+		return nil, errors.New("server returned status " + http.StatusText(status))
+	}
+	logger.Println("U00Client WriteValue success:", url, "response:", string(respBS))
+	var result SetResult
+	err = json.Unmarshal(respBS, &result)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	return &result, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// WriteValue writes the value to the primary and the replica and
+// returns the receipts of the nodes that accepted it; see writeFrame.
+func (c *U00Client) WriteValue(name string, dt time.Time, value string) ([]*receipt.Receipt, error) {
+	return c.WriteValueTTLContext(context.Background(), name, dt, value, 0)
+}
+
+func (c *U00Client) WriteValueContext(ctx context.Context, name string, dt time.Time, value string) ([]*receipt.Receipt, error) {
+	return c.WriteValueTTLContext(ctx, name, dt, value, 0)
+}
+
+// WriteValueTTL writes a value that the servers drop after ttl. The
+// servers clamp ttl to their maximum; 0 means the server default.
+func (c *U00Client) WriteValueTTL(name string, dt time.Time, value string, ttl time.Duration) ([]*receipt.Receipt, error) {
+	return c.WriteValueTTLContext(context.Background(), name, dt, value, ttl)
+}
+
+func (c *U00Client) WriteValueTTLContext(ctx context.Context, name string, dt time.Time, value string, ttl time.Duration) ([]*receipt.Receipt, error) {
+	frameBS, err := c.encodeValue(name, dt, value, ttl)
 	if err != nil {
-		return nil, resp.StatusCode, err
+		return nil, err
 	}
 
-	return body, resp.StatusCode, nil
+	return c.writeFrame(ctx, frameBS)
 }
 
-func (c *U00Client) writeValueToServer(url string, data []byte) error {
-	respBS, status, err := c.sendPostBytes(url, data, "application/octet-stream")
-	if err != nil {
-		logger.Println("U00Client WriteValue error:", err, respBS, status)
-		return err
+func (c *U00Client) encodeValue(name string, dt time.Time, value string, ttl time.Duration) ([]byte, error) {
+	if len(c.privateKey) != 64 || len(c.publicKey) != 32 {
+		return nil, errors.New("private key is not set or public key is empty")
 	}
-	if status != http.StatusOK {
-		logger.Println("U00Client WriteValue error: status", status, "response:", string(respBS))
-		return errors.New("server returned status " + http.StatusText(status))
+
+	f := frame.Frame{
+		Version: c.frameVersion,
+		Name:    name,
+		Value:   []byte(value),
+		Time:    dt,
+		TTL:     ttl,
 	}
-	logger.Println("U00Client WriteValue success:", url, "response:", string(respBS))
-	return nil
-}
-
-func (c *U00Client) getNextDomain(domain string) string {
-	if len(domain) == 0 {
-		return "0"
-	}
-	nextDomain := ""
-	switch domain[0] {
-	case '0', '1', '2', '3', '4', '5', '6', '7', '8':
-		nextDomain = string(domain[0] + 1)
-	case '9':
-		nextDomain = "a"
-	case 'a', 'b', 'c', 'd', 'e':
-		nextDomain = string(domain[0] + 1)
-	case 'f':
-		nextDomain = "0"
-	default:
-		return ""
+	if f.Version == frame.Version2 {
+		f.Seq = c.seq.Add(1)
+		f.ContentType = frame.ContentTypeText
+		if len(value) > 128 {
+			f.Flags |= frame.FlagDeflate
+		}
 	}
-	return nextDomain
+	return frame.Encode(c.privateKey, &f)
+}
+
+// DeleteValue replaces the named value with a signed tombstone.
+func (c *U00Client) DeleteValue(name string) error {
+	return c.DeleteValueContext(context.Background(), name)
 }
 
-func (c *U00Client) WriteValue(name string, dt time.Time, value string) error {
+func (c *U00Client) DeleteValueContext(ctx context.Context, name string) error {
 	if len(c.privateKey) != 64 || len(c.publicKey) != 32 {
 		return errors.New("private key is not set or public key is empty")
 	}
 
-	var err error
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
-	var zipFile io.Writer
-	{
-		zipFile, err = zipWriter.Create("value")
-		if err == nil {
-			zipFile.Write([]byte(value))
-		}
+	f := frame.Frame{
+		Version: c.frameVersion,
+		Name:    name,
+		Time:    time.Now(),
+		Delete:  true,
 	}
-	{
-		zipFile, err = zipWriter.Create("name")
-		if err == nil {
-			zipFile.Write([]byte(name))
-		}
+	if f.Version == frame.Version2 {
+		f.Seq = c.seq.Add(1)
 	}
-	{
-		value = dt.Format("2006-01-02 15:04:05.000")
-		zipFile, err = zipWriter.Create("time")
-		if err == nil {
-			zipFile.Write([]byte(value))
-		}
+	frameBS, err := frame.Encode(c.privateKey, &f)
+	if err != nil {
+		return err
 	}
-	zipWriter.Close()
-	zipFileContent := buf.Bytes()
-
-	signature := ed25519.Sign(c.privateKey, zipFileContent)
 
-	frame := make([]byte, 32+len(zipFileContent)+64)
-	copy(frame[:32], c.publicKey)
-	copy(frame[32:32+64], signature)
-	copy(frame[32+64:], zipFileContent)
-
-	domain1 := hex.EncodeToString(c.publicKey[:1])
-	domain1 = domain1[:1]
-	domain2 := c.getNextDomain(domain1)
-
-	c.writeValueToServer("https://s"+domain1+".u00.io/set", frame)
-	c.writeValueToServer("https://s"+domain2+".u00.io/set", frame)
+	_, err = c.writeFrame(ctx, frameBS)
+	return err
+}
 
-	return nil
+// CompareAndSwap writes the value only if the stored version of the entry
+// equals expectedVersion (0 - the entry does not exist yet) and returns
+// the new version. The primary host decides; the replica is updated
+// after it.
+func (c *U00Client) CompareAndSwap(name string, expectedVersion uint64, value string) (uint64, error) {
+	return c.CompareAndSwapContext(context.Background(), name, expectedVersion, value)
 }
 
-func (c *U00Client) ReadValue(address string) (value []byte, err error) {
-	if len(c.publicKey) != 32 {
-		return nil, errors.New("public key is not set or invalid")
+func (c *U00Client) CompareAndSwapContext(ctx context.Context, name string, expectedVersion uint64, value string) (uint64, error) {
+	if len(c.privateKey) != 64 || len(c.publicKey) != 32 {
+		return 0, errors.New("private key is not set or public key is empty")
 	}
 
-	domain := hex.EncodeToString(c.publicKey[:1])
-	domain = domain[:1]
-
-	bs, err := http.Get("https://s" + domain + ".u00.io/get/" + address)
+	f := frame.Frame{
+		Version:            c.frameVersion,
+		Name:               name,
+		Value:              []byte(value),
+		Time:               time.Now(),
+		HasExpectedVersion: true,
+		ExpectedVersion:    expectedVersion,
+	}
+	if f.Version == frame.Version2 {
+		f.Seq = c.seq.Add(1)
+	}
+	frameBS, err := frame.Encode(c.privateKey, &f)
 	if err != nil {
-		logger.Println("U00Client ReadValue error:", err)
-		return nil, err
+		return 0, err
 	}
 
-	data, err := io.ReadAll(bs.Body)
-	bs.Body.Close()
+	result, err := c.writeToNode(ctx, 0, frameBS)
 	if err != nil {
-		logger.Println("U00Client ReadValue error reading body:", err)
+		return 0, err
+	}
+	for i := 1; i < len(c.serverUrls(ctx)); i++ {
+		c.writeToNode(ctx, i, frameBS)
+	}
+	return result.Version, nil
+}
+
+// serverUrls returns the primary and the replica host of the client's
+// own address.
+func (c *U00Client) serverUrls(ctx context.Context) []string {
+	return c.TopologyContext(ctx).NodesFor(c.publicKey)
+}
+
+// writeToNode writes the frame to the i-th node of the client's address,
+// 0 being the primary. If the node redirects or fails the topology is
+// reloaded and the write is retried once.
+func (c *U00Client) writeToNode(ctx context.Context, i int, frameBS []byte) (*SetResult, error) {
+	urls := c.serverUrls(ctx)
+	if i >= len(urls) {
+		return nil, errNoNode
+	}
+	result, err := c.writeValueToServer(ctx, urls[i]+"/set", frameBS)
+	if err == nil || !needsRefresh(err) || ctx.Err() != nil {
+		return result, err
+	}
+	urls = c.refreshTopology(ctx).NodesFor(c.publicKey)
+	if i >= len(urls) {
 		return nil, err
 	}
+	return c.writeValueToServer(ctx, urls[i]+"/set", frameBS)
+}
+
+// writeFrame writes the frame to every node of the address and collects
+// their receipts, one per node that accepted the frame. The receipt of a
+// node that stored the frame without a valid receipt is nil. It fails
+// only if no node accepted the frame.
+func (c *U00Client) writeFrame(ctx context.Context, frameBS []byte) ([]*receipt.Receipt, error) {
+	receipts := make([]*receipt.Receipt, 0)
+	var lastErr error
+	for i := range c.serverUrls(ctx) {
+		result, err := c.writeToNode(ctx, i, frameBS)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		receipts = append(receipts, verifiedReceipt(result, frameBS))
+	}
+	if len(receipts) == 0 {
+		if lastErr == nil {
+			lastErr = errNoNode
+		}
+		return nil, lastErr
+	}
+	return receipts, nil
+}
 
-	fmt.Println("GET response:", hex.EncodeToString(data))
-	return nil, nil
+// verifiedReceipt returns the receipt of the result if it is valid for
+// the frame. A missing or broken receipt does not undo the stored write.
+func verifiedReceipt(result *SetResult, frameBS []byte) *receipt.Receipt {
+	if result.Receipt == nil {
+		logger.Println("U00Client receipt error: the node returned no receipt")
+		return nil
+	}
+	err := result.Receipt.VerifyFrame(frameBS)
+	if err != nil {
+		logger.Println("U00Client receipt error:", err)
+		return nil
+	}
+	return result.Receipt
 }